@@ -4,6 +4,7 @@ package main
 import (
 	"crypto/rand"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
@@ -24,6 +25,16 @@ import (
 var profile = false
 var debug = false
 
+//check downloaded blocks against the hash their uploader sent
+var verifyHashes = false
+
+//tag requests, uploads and downloads with a random trace id the servers log
+var traceCalls = false
+
+//how much longer than others late rounds wait on this client, in units of
+//the servers' -prioritygrace
+var priority = 0
+
 //assumes RPC model of communication
 type Client struct {
 	id           int      //client id
@@ -53,6 +64,8 @@ type Client struct {
 	secretss [][][]byte  //secret for data
 
 	rounds []*Round
+
+	trace string //sent with every call, with traceCalls
 }
 
 type Round struct {
@@ -63,6 +76,8 @@ type Round struct {
 	reqHashesChan chan [][]byte
 	dhashChan     chan []byte
 	upHashesChan  chan [][]byte
+
+	keys [][]byte //this slot's keys, with RoundKeys
 }
 
 func NewClient(servers []string, myServer string, FSMode bool) *Client {
@@ -81,6 +96,19 @@ func NewClient(servers []string, myServer string, FSMode bool) *Client {
 		rpcServers[i] = rpcServer
 	}
 
+	//fail fast if the servers were built with different parameters
+	for _, rpcServer := range rpcServers {
+		var params Params
+		err := rpcServer.Call("Server.GetParams", 0, &params)
+		if err != nil {
+			log.Fatal("Couldn't get server's parameters: ", err)
+		}
+		err = LocalParams(suite, len(servers)).Check(params)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	pks := make([]abstract.Point, len(servers))
 	var wg sync.WaitGroup
 	for i, rpcServer := range rpcServers {
@@ -108,6 +136,8 @@ func NewClient(servers []string, myServer string, FSMode bool) *Client {
 			reqHashesChan: make(chan [][]byte),
 			dhashChan:     make(chan []byte),
 			upHashesChan:  make(chan [][]byte),
+
+			keys: make([][]byte, len(servers)),
 		}
 		rounds[i] = &r
 	}
@@ -140,6 +170,12 @@ func NewClient(servers []string, myServer string, FSMode bool) *Client {
 
 		rounds: rounds,
 	}
+	if traceCalls {
+		id := make([]byte, 8)
+		rand.Read(id)
+		c.trace = fmt.Sprintf("%x", id)
+		log.Println("trace id", c.trace)
+	}
 
 	return &c
 }
@@ -148,12 +184,72 @@ func NewClient(servers []string, myServer string, FSMode bool) *Client {
 //Registration and Setup
 ////////////////////////////////
 func (c *Client) Register(idx int) {
-	var id int
-	err := c.rpcServers[idx].Call("Server.Register", c.myServer, &id)
+	var reply RegisterReply
+	register := func() error {
+		if priority != 0 {
+			args := RegisterArgs{ServerId: c.myServer, Priority: priority}
+			return c.rpcServers[idx].Call("Server.RegisterPriority", &args, &reply)
+		}
+		return c.rpcServers[idx].Call("Server.Register", c.myServer, &reply)
+	}
+	err := register()
+	for Retriable(err) {
+		time.Sleep(100 * time.Millisecond)
+		err = register()
+	}
 	if err != nil {
-		log.Fatal("Couldn't register: ", err)
+		log.Fatal("Couldn't register: ", RPCError(err))
+	}
+	c.registered(reply)
+}
+
+//registers without waiting on the cluster: fails with ErrNotAccepting
+//(or ErrClusterFull, ...) instead of blocking or retrying
+func (c *Client) TryRegister(idx int) error {
+	var reply RegisterReply
+	err := c.rpcServers[idx].Call("Server.TryRegister", c.myServer, &reply)
+	if err != nil {
+		return RPCError(err)
+	}
+	c.registered(reply)
+	return nil
+}
+
+func (c *Client) registered(reply RegisterReply) {
+	c.id = reply.Id
+	c.myServer = reply.ServerId
+	//downloads have to go where the cluster routes this client's blocks,
+	//even if our list names that server differently
+	if c.servers[c.myServer] != reply.ServerAddr {
+		rpcServer, err := rpc.Dial("tcp", reply.ServerAddr)
+		if err != nil {
+			log.Fatal("Cannot connect to my server: ", err)
+		}
+		c.rpcServers[c.myServer] = rpcServer
+	}
+}
+
+//the server with the fewest clients, then the fewest rounds in flight;
+//servers that don't answer are passed over
+func (c *Client) LeastLoaded() int {
+	best := c.myServer
+	var bestLoad *LoadInfo
+	for i, rpcServer := range c.rpcServers {
+		if !TakesClients(i) {
+			continue
+		}
+		var load LoadInfo
+		err := rpcServer.Call("Server.GetServerLoad", 0, &load)
+		if err != nil {
+			continue
+		}
+		if bestLoad == nil || load.Clients < bestLoad.Clients ||
+			(load.Clients == bestLoad.Clients && load.Rounds < bestLoad.Rounds) {
+			best = i
+			bestLoad = &load
+		}
 	}
-	c.id = id
+	return best
 }
 
 func (c *Client) RegisterDone(idx int) {
@@ -164,7 +260,7 @@ func (c *Client) RegisterDone(idx int) {
 	}
 	c.totalClients = totalClients
 
-	size := (totalClients/SecretSize)*SecretSize + SecretSize
+	size := MaskSize(totalClients)
 	c.maskss = make([][][]byte, MaxRounds)
 	c.secretss = make([][][]byte, MaxRounds)
 	for r := range c.maskss {
@@ -181,27 +277,38 @@ func (c *Client) UploadKeys(idx int) {
 	if c.id == 0 {
 		defer TimeTrack(time.Now(), "sharing keys")
 	}
-	c1s := make([]abstract.Point, len(c.servers))
-	c2s := make([]abstract.Point, len(c.servers))
+	c.uploadKeys(idx, 0, c.keys)
+}
+
+//fresh keys for round rnd, when every round shuffles its own
+func (c *Client) UploadRoundKeys(idx int, rnd uint64) {
+	c.uploadKeys(idx, rnd, c.rounds[rnd%MaxRounds].keys)
+}
+
+func (c *Client) uploadKeys(idx int, rnd uint64, keys [][]byte) {
+	//KeyChunks points per server; server i's are at i*KeyChunks on
+	c1s := make([]abstract.Point, len(c.servers)*KeyChunks)
+	c2s := make([]abstract.Point, len(c.servers)*KeyChunks)
 
 	gen := c.g.Point().Base()
 	rand := c.suite.Cipher(abstract.RandomKey)
-	keyPts := make([]abstract.Point, len(c.servers))
-	for i := range keyPts {
-		secret := c.g.Scalar().Pick(rand)
-		public := c.g.Point().Mul(gen, secret)
-		keyPts[i] = public
-		c.keys[i] = MarshalPoint(public)
-	}
-
 	for i := range c.servers {
-		c1s[i], c2s[i] = EncryptKey(c.g, keyPts[i], c.pks[:i+1])
+		chunks := make([][]byte, KeyChunks)
+		for k := range chunks {
+			secret := c.g.Scalar().Pick(rand)
+			public := c.g.Point().Mul(gen, secret)
+			chunks[k] = MarshalPoint(public)
+			row := i*KeyChunks + k
+			c1s[row], c2s[row] = EncryptKey(c.g, public, c.pks[:i+1], rand)
+		}
+		keys[i] = KeyFromChunks(chunks)
 	}
 
 	upkey := UpKey{
-		C1s: make([][]byte, len(c1s)),
-		C2s: make([][]byte, len(c1s)),
-		Id:  c.id,
+		C1s:   make([][]byte, len(c1s)),
+		C2s:   make([][]byte, len(c1s)),
+		Id:    c.id,
+		Round: rnd,
 	}
 
 	for i := range c1s {
@@ -214,13 +321,62 @@ func (c *Client) UploadKeys(idx int) {
 		log.Fatal("Couldn't upload a key: ", err)
 	}
 
-	err = c.rpcServers[idx].Call("Server.KeyReady", c.id, nil)
+	err = c.rpcServers[idx].Call("Server.KeyReady", &RequestArg{Id: c.id, Round: rnd}, nil)
 	if err != nil {
 		log.Fatal("Couldn't determine key ready", err)
 	}
 }
 
 //share one time secret with the server
+//starts this client's mask and secret chains over with every server from
+//round rnd on, for when they fell out of step; no round may be in flight
+func (c *Client) RotateKeys(rnd uint64) {
+	gen := c.g.Point().Base()
+	rand := c.suite.Cipher(abstract.RandomKey)
+	secret1 := c.g.Scalar().Pick(rand)
+	secret2 := c.g.Scalar().Pick(rand)
+	rot := ClientRotation{
+		Mask:   MarshalPoint(c.g.Point().Mul(gen, secret1)),
+		Secret: MarshalPoint(c.g.Point().Mul(gen, secret2)),
+		Id:     c.id,
+		Round:  rnd,
+	}
+
+	masks := make([][]byte, len(c.servers))
+	secrets := make([][]byte, len(c.servers))
+	var wg sync.WaitGroup
+	for i, rpcServer := range c.rpcServers {
+		wg.Add(1)
+		go func(i int, rpcServer *rpc.Client) {
+			defer wg.Done()
+			var reply RotationReply
+			err := rpcServer.Call("Server.RotateClientKeys", &rot, &reply)
+			if err != nil {
+				log.Fatal("Couldn't rotate keys: ", err)
+			}
+			masks[i] = MarshalPoint(c.g.Point().Mul(UnmarshalPoint(c.suite, reply.Mask), secret1))
+			secrets[i] = MarshalPoint(c.g.Point().Mul(UnmarshalPoint(c.suite, reply.Secret), secret2))
+		}(i, rpcServer)
+	}
+	wg.Wait()
+
+	for i := range c.servers {
+		seedChain(c.maskss, i, masks[i], rnd)
+		seedChain(c.secretss, i, secrets[i], rnd)
+	}
+}
+
+//same as the server's: round from gets hash(seed), and each round after
+//the hash of the one before
+func seedChain(chains [][][]byte, i int, seed []byte, from uint64) {
+	prev := seed
+	for k := uint64(0); k < MaxRounds; k++ {
+		rnd := (from + k) % MaxRounds
+		sha3.ShakeSum256(chains[rnd][i], prev)
+		prev = chains[rnd][i]
+	}
+}
+
 func (c *Client) ShareSecret() {
 	gen := c.g.Point().Base()
 	rand := c.suite.Cipher(abstract.RandomKey)
@@ -267,26 +423,10 @@ func (c *Client) ShareSecret() {
 	}
 	wg.Wait()
 
-	for r := range c.secretss {
-		for i := range c.secretss[r] {
-			if r == 0 {
-				sha3.ShakeSum256(c.secretss[r][i], secrets[i])
-			} else {
-				sha3.ShakeSum256(c.secretss[r][i], c.secretss[r-1][i])
-			}
-		}
-	}
-
-	for r := range c.maskss {
-		for i := range c.maskss[r] {
-			if r == 0 {
-				sha3.ShakeSum256(c.maskss[r][i], masks[i])
-			} else {
-				sha3.ShakeSum256(c.maskss[r][i], c.maskss[r-1][i])
-			}
-		}
+	for i := range c.servers {
+		seedChain(c.secretss, i, secrets[i], 0)
+		seedChain(c.maskss, i, masks[i], 0)
 	}
-
 }
 
 /////////////////////////////////
@@ -295,7 +435,7 @@ func (c *Client) ShareSecret() {
 func (c *Client) RequestBlock(hash []byte, rnd uint64) ([]byte, [][]byte) {
 	t := time.Now()
 
-	req := Request{Hash: c.seal(hash, rnd), Round: rnd, Id: c.id}
+	req := Request{Hash: c.seal(hash, rnd), Round: rnd, Id: c.id, Trace: c.trace}
 
 	if rnd == 0 && debug {
 		fmt.Println(c.id, rnd, "requesting", req.Hash)
@@ -304,6 +444,10 @@ func (c *Client) RequestBlock(hash []byte, rnd uint64) ([]byte, [][]byte) {
 	t = time.Now()
 	var hashes [][]byte
 	err := c.rpcServers[c.myServer].Call("Server.RequestBlock", &req, &hashes)
+	for Retriable(err) {
+		time.Sleep(100 * time.Millisecond)
+		err = c.rpcServers[c.myServer].Call("Server.RequestBlock", &req, &hashes)
+	}
 	if err != nil {
 		log.Fatal("Couldn't request a block: ", err)
 	}
@@ -355,6 +499,7 @@ func (c *Client) Upload(hashes [][]byte, rnd uint64) [][]byte {
 
 func (c *Client) UploadBlock(block Block) [][]byte {
 	block.Block = c.seal(block.Block, block.Round)
+	block.Trace = c.trace
 
 	var hashes [][]byte
 	t := time.Now()
@@ -370,7 +515,12 @@ func (c *Client) UploadBlock(block Block) [][]byte {
 
 func (c *Client) UploadSmall(block Block) {
 	block.Block = c.seal(block.Block, block.Round)
+	block.Trace = c.trace
 	err := c.rpcServers[c.myServer].Call("Server.UploadSmall", &block, nil)
+	for Retriable(err) {
+		time.Sleep(100 * time.Millisecond)
+		err = c.rpcServers[c.myServer].Call("Server.UploadSmall", &block, nil)
+	}
 	if err != nil {
 		log.Fatal("Couldn't upload a block: ", err)
 	}
@@ -421,21 +571,35 @@ func (c *Client) DownloadSlot(slot int, rnd uint64) []byte {
 	Xor(finalMask, mask)
 
 	//one response includes all the secrets
-	response := make([]byte, BlockSize)
+	var res RoundResult
 	secretsXor := Xors(c.secretss[round])
-	cMask := ClientMask{Mask: mask, Id: c.id, Round: rnd}
+	cMask := ClientMask{Mask: mask, Id: c.id, Round: rnd, WithHashes: verifyHashes && c.FSMode, Trace: c.trace}
 
 	t := time.Now()
-	err := c.rpcServers[c.myServer].Call("Server.GetResponse", cMask, &response)
+	err := c.rpcServers[c.myServer].Call("Server.GetRoundResult", cMask, &res)
 	if err != nil {
 		log.Fatal("Could not get response: ", err)
 	}
+	if res.Round != rnd || res.Contributions != len(c.servers) {
+		log.Printf("round %d: response is for round %d with %d/%d servers' contributions",
+			rnd, res.Round, res.Contributions, len(c.servers))
+	}
+	if res.Substituted > 0 {
+		log.Printf("round %d: %d blocks were replaced or dropped", rnd, res.Substituted)
+	}
+	response := res.Block
 
 	if c.id == 0 && profile {
 		fmt.Println(c.id, "down_network_total:", time.Since(t))
 	}
 
-	Xor(secretsXor, response)
+	response = ReconstructBlock([][]byte{response}, secretsXor)
+	if cMask.WithHashes {
+		err = c.checkHash(response, res.Hashes, slot)
+		if err != nil {
+			log.Printf("round %d: slot %d: %v", rnd, slot, err)
+		}
+	}
 
 	for i := range c.secretss[round] {
 		sha3.ShakeSum256(c.secretss[round][i], c.secretss[round][i])
@@ -448,6 +612,76 @@ func (c *Client) DownloadSlot(slot int, rnd uint64) []byte {
 	return response
 }
 
+//slot's block of an already finished round, from the servers' archives;
+//the mask is split randomly across all servers, so no one server learns
+//the slot, but all of them have to run with -archive
+func (c *Client) DownloadArchived(slot int, rnd uint64) ([]byte, error) {
+	maskSize := len(c.maskss[rnd%MaxRounds][0])
+	masks := make([][]byte, len(c.servers))
+	last := make([]byte, maskSize)
+	SetBit(slot, true, last)
+	for i := range masks[:len(masks)-1] {
+		masks[i] = make([]byte, maskSize)
+		rand.Read(masks[i])
+		Xor(masks[i], last)
+	}
+	masks[len(masks)-1] = last
+
+	responses := make([][]byte, len(c.servers))
+	errs := make(chan error, len(c.servers))
+	for i, rpcServer := range c.rpcServers {
+		go func(i int, rpcServer *rpc.Client) {
+			req := ArchiveRequest{Round: rnd, Mask: masks[i]}
+			errs <- rpcServer.Call("Server.GetArchivedResponse", &req, &responses[i])
+		}(i, rpcServer)
+	}
+	var err error
+	for range c.rpcServers {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ReconstructBlock(responses, nil), nil
+}
+
+//a slot whose uploader had nothing to send has no hash to check against
+func (c *Client) checkHash(block []byte, hashes [][]byte, slot int) error {
+	if slot >= len(hashes) {
+		return fmt.Errorf("no upload hash for slot, server sent %d", len(hashes))
+	}
+	if len(hashes[slot]) == 0 {
+		return nil
+	}
+	h := NewHash(c.suite)
+	h.Write(block[:BlockSize])
+	if !SliceEquals(h.Sum(nil), hashes[slot]) {
+		return errors.New("block doesn't match its upload hash")
+	}
+	return nil
+}
+
+//leaves for good: every server wipes its masks and secrets for this
+//client, and so does the client
+func (c *Client) Deregister() error {
+	var err error
+	for i, rpcServer := range c.rpcServers {
+		e := rpcServer.Call("Server.Deregister", c.id, nil)
+		if e != nil && err == nil {
+			err = fmt.Errorf("server %d: %v", i, e)
+		}
+	}
+	for r := range c.maskss {
+		for i := range c.maskss[r] {
+			Xor(c.maskss[r][i], c.maskss[r][i])
+			Xor(c.secretss[r][i], c.secretss[r][i])
+		}
+	}
+	return err
+}
+
 /////////////////////////////////
 //Misc (mostly for testing)
 ////////////////////////////////
@@ -457,17 +691,21 @@ func (c *Client) seal(input []byte, round uint64) []byte {
 	binary.PutUvarint(rnd, round)
 	nonce := [24]byte{}
 	copy(nonce[:], rnd[:])
+	keys := c.keys
+	if RoundKeys {
+		keys = c.rounds[round%MaxRounds].keys
+	}
 	for i := range c.servers {
 		idx := len(c.servers) - i - 1
 		key := [32]byte{}
-		copy(key[:], c.keys[idx][:])
+		copy(key[:], keys[idx][:])
 		msg = secretbox.Seal(nil, msg, &nonce, &key)
 	}
 	return msg
 }
 
 func (c *Client) RegisterBlock(block []byte) {
-	h := c.suite.Hash()
+	h := NewHash(c.suite)
 	h.Write(block)
 	hash := h.Sum(nil)
 	c.testPieces[string(hash)] = block
@@ -485,7 +723,7 @@ func (c *Client) UploadPieces(hashes [][]byte, rnd uint64) {
 		break
 	}
 
-	h := c.suite.Hash()
+	h := NewHash(c.suite)
 	h.Write(match)
 	match = h.Sum(match)
 	if rnd == 0 && debug {
@@ -525,17 +763,63 @@ func main() {
 	var wf *string = flag.String("w", "", "wanted [file]") //torrent file
 	var f *string = flag.String("f", "", "file [file]")    //file in possession
 	var s *int = flag.Int("i", 0, "server [id]")           //server id you are connectin to
-	var servers *string = flag.String("s", "", "servers [file]")
+	var servers *string = flag.String("s", "", "servers [file, - for stdin, or set SERVERS=host:port,...]")
 	var mode *string = flag.String("m", "", "mode [m for microblogging|f for file sharing]")
+	flag.StringVar(&HashFunc, "hash", "suite", "block hash [suite|sha3|blake2b]")
+	flag.BoolVar(&RoundKeys, "roundkeys", false, "shuffle fresh keys every round")
+	var coord *int = flag.Int("coordinator", 0, "server to register with")
+	var pick *bool = flag.Bool("pick", false, "register with the least loaded server instead of -i")
+	var failFast *bool = flag.Bool("failfast", false, "give up if the cluster isn't taking registrations right away")
+	flag.IntVar(&priority, "priority", 0, "register with this priority, for servers with -prioritygrace")
+	flag.BoolVar(&traceCalls, "trace", false, "tag calls with a trace id the servers log")
+	flag.BoolVar(&verifyHashes, "verifyhash", false, "check downloaded blocks against their upload hashes")
+	flag.IntVar(&KeyChunks, "keychunks", 1, "points each key is made of, must match the servers")
+	var shuffleOnly *string = flag.String("shuffleonly", "", "ids of servers that only shuffle, must match the servers [e.g. 1,3]")
 	flag.Parse()
 
+	if err := CheckSizes(); err != nil {
+		log.Fatal(err)
+	}
+	if err := CheckHashFunc(HashFunc); err != nil {
+		log.Fatal(err)
+	}
+	if KeyChunks < 1 {
+		log.Fatal("Bad -keychunks: need at least one chunk per key")
+	}
+
 	ss := ParseServerList(*servers)
+	if *s < 0 || *s >= len(ss) {
+		log.Fatalf("server id %d out of range (have %d servers)", *s, len(ss))
+	}
+	ids, err := ParseShuffleOnly(*shuffleOnly, len(ss))
+	if err != nil {
+		log.Fatal("Bad -shuffleonly: ", err)
+	}
+	ShuffleOnly = ids
+	if !TakesClients(*s) && !*pick {
+		log.Fatalf("server %d only shuffles, pick another with -i or -pick", *s)
+	}
 
 	c := NewClient(ss, ss[*s], *mode == "f")
-	c.Register(0)
-	c.RegisterDone(0)
+	if *pick {
+		c.myServer = c.LeastLoaded()
+	}
+	if *coord < 0 || *coord >= len(ss) {
+		log.Fatalf("coordinator %d out of range (have %d servers)", *coord, len(ss))
+	}
+	if *failFast {
+		err := c.TryRegister(*coord)
+		if err != nil {
+			log.Fatal("Couldn't register: ", err)
+		}
+	} else {
+		c.Register(*coord)
+	}
+	c.RegisterDone(*coord)
 	c.ShareSecret()
-	c.UploadKeys(0)
+	if !RoundKeys {
+		c.UploadKeys(0)
+	}
 
 	fmt.Println("Started client", c.id)
 
@@ -576,6 +860,9 @@ func main() {
 			go func(r uint64) {
 				defer wg.Done()
 				for r < uint64(len(wantedArr)) {
+					if RoundKeys {
+						c.UploadRoundKeys(0, r)
+					}
 					hash, hashes := c.RequestBlock(wantedArr[r], r)
 					hashes = c.Upload(hashes, r)
 					res := c.Download(hash, hashes, r)
@@ -603,6 +890,9 @@ func main() {
 			go func(r uint64) {
 				defer wg.Done()
 				for r < MaxRounds*3 {
+					if RoundKeys {
+						c.UploadRoundKeys(0, r)
+					}
 					block := make([]byte, BlockSize)
 					rand.Read(block)
 					c.UploadSmall(Block{Block: block, Round: r, Id: c.id})
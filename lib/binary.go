@@ -0,0 +1,213 @@
+package lib
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+//flat encodings of the key shuffle messages, which are mostly nested byte
+//slices; much cheaper than gob for them. Lengths and ints are varints.
+//Gob uses these too, so either codec carries the version below.
+
+//first varint of every key shuffle message; bump it whenever their
+//layout changes, so a peer built from other sources is caught at its
+//first message instead of decoding into garbage points
+const KeyMsgVersion = 1
+
+var errShortBuffer = errors.New("binary: truncated message")
+
+type binWriter struct {
+	buf []byte
+}
+
+func (w *binWriter) uint(x uint64) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], x)
+	w.buf = append(w.buf, tmp[:n]...)
+}
+
+func (w *binWriter) int(x int) {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(tmp[:], int64(x))
+	w.buf = append(w.buf, tmp[:n]...)
+}
+
+func (w *binWriter) bytes(b []byte) {
+	w.uint(uint64(len(b)))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *binWriter) bytess(bs [][]byte) {
+	w.uint(uint64(len(bs)))
+	for _, b := range bs {
+		w.bytes(b)
+	}
+}
+
+func (w *binWriter) bytesss(bss [][][]byte) {
+	w.uint(uint64(len(bss)))
+	for _, bs := range bss {
+		w.bytess(bs)
+	}
+}
+
+//reads what binWriter wrote; the first error sticks and later reads are zero
+type binReader struct {
+	buf []byte
+	err error
+}
+
+func (r *binReader) uint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(r.buf)
+	if n <= 0 {
+		r.err = errShortBuffer
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return x
+}
+
+func (r *binReader) int() int {
+	if r.err != nil {
+		return 0
+	}
+	x, n := binary.Varint(r.buf)
+	if n <= 0 {
+		r.err = errShortBuffer
+		return 0
+	}
+	r.buf = r.buf[n:]
+	return int(x)
+}
+
+//a length, checked against what's left so a bad one can't cause a huge
+//allocation; every element takes at least a byte
+func (r *binReader) len() int {
+	n := r.uint()
+	if n > uint64(len(r.buf)) {
+		r.err = errShortBuffer
+		return 0
+	}
+	return int(n)
+}
+
+func (r *binReader) bytes() []byte {
+	n := r.len()
+	if r.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, r.buf)
+	r.buf = r.buf[n:]
+	return b
+}
+
+func (r *binReader) bytess() [][]byte {
+	n := r.len()
+	if r.err != nil {
+		return nil
+	}
+	bs := make([][]byte, n)
+	for i := range bs {
+		bs[i] = r.bytes()
+	}
+	return bs
+}
+
+func (r *binReader) bytesss() [][][]byte {
+	n := r.len()
+	if r.err != nil {
+		return nil
+	}
+	bss := make([][][]byte, n)
+	for i := range bss {
+		bss[i] = r.bytess()
+	}
+	return bss
+}
+
+//checks the version a key shuffle message starts with
+func (r *binReader) version(msg string) {
+	v := r.uint()
+	if r.err == nil && v != KeyMsgVersion {
+		r.err = fmt.Errorf("unsupported %s version %d (have %d)", msg, v, KeyMsgVersion)
+	}
+}
+
+func (ik InternalKey) MarshalBinary() ([]byte, error) {
+	w := binWriter{}
+	w.uint(KeyMsgVersion)
+	w.bytesss(ik.Xss)
+	w.bytesss(ik.Yss)
+	w.int(ik.SId)
+	w.bytesss(ik.Ybarss)
+	w.bytess(ik.Proofs)
+	w.bytess(ik.Keys)
+	w.uint(ik.Round)
+	return w.buf, nil
+}
+
+func (ik *InternalKey) UnmarshalBinary(data []byte) error {
+	r := binReader{buf: data}
+	r.version("InternalKey")
+	ik.Xss = r.bytesss()
+	ik.Yss = r.bytesss()
+	ik.SId = r.int()
+	ik.Ybarss = r.bytesss()
+	ik.Proofs = r.bytess()
+	ik.Keys = r.bytess()
+	ik.Round = r.uint()
+	return r.err
+}
+
+func (aux AuxKeyProof) MarshalBinary() ([]byte, error) {
+	w := binWriter{}
+	w.uint(KeyMsgVersion)
+	w.bytesss(aux.OrigXss)
+	w.bytesss(aux.OrigYss)
+	w.int(aux.SId)
+	w.uint(aux.Round)
+	return w.buf, nil
+}
+
+func (aux *AuxKeyProof) UnmarshalBinary(data []byte) error {
+	r := binReader{buf: data}
+	r.version("AuxKeyProof")
+	aux.OrigXss = r.bytesss()
+	aux.OrigYss = r.bytesss()
+	aux.SId = r.int()
+	aux.Round = r.uint()
+	return r.err
+}
+
+func (c AuxKeyChunk) MarshalBinary() ([]byte, error) {
+	w := binWriter{}
+	w.uint(KeyMsgVersion)
+	w.int(c.SId)
+	w.int(c.Row)
+	w.int(c.Offset)
+	w.bytess(c.Xs)
+	w.bytess(c.Ys)
+	w.uint(c.Round)
+	w.int(c.Rows)
+	w.int(c.Clients)
+	return w.buf, nil
+}
+
+func (c *AuxKeyChunk) UnmarshalBinary(data []byte) error {
+	r := binReader{buf: data}
+	r.version("AuxKeyChunk")
+	c.SId = r.int()
+	c.Row = r.int()
+	c.Offset = r.int()
+	c.Xs = r.bytess()
+	c.Ys = r.bytess()
+	c.Round = r.uint()
+	c.Rows = r.int()
+	c.Clients = r.int()
+	return r.err
+}
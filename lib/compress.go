@@ -0,0 +1,39 @@
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+)
+
+func PackBlocks(blocks []Block, compress bool) (*BlockBatch, error) {
+	if !compress {
+		return &BlockBatch{Blocks: blocks}, nil
+	}
+	buf := new(bytes.Buffer)
+	zw := gzip.NewWriter(buf)
+	err := gob.NewEncoder(zw).Encode(blocks)
+	if err != nil {
+		return nil, err
+	}
+	err = zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return &BlockBatch{Packed: buf.Bytes()}, nil
+}
+
+//works on either form, so receivers don't need to know how the sender is configured
+func (b *BlockBatch) Unpack() ([]Block, error) {
+	if b.Packed == nil {
+		return b.Blocks, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(b.Packed))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	var blocks []Block
+	err = gob.NewDecoder(zr).Decode(&blocks)
+	return blocks, err
+}
@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"errors"
+	"net/rpc"
+	"strings"
+)
+
+//errors servers return to clients
+var (
+	ErrRoundExpired = errors.New("round expired")
+	ErrClusterFull  = errors.New("cluster full")
+	ErrRateLimited  = errors.New("rate limited, retry later")
+	ErrNotReady     = errors.New("not ready, retry later")
+	ErrBadBlockSize = errors.New("bad block size")
+	ErrDraining     = errors.New("draining, use another server")
+	ErrNotEntry     = errors.New("not an entry server, use another server")
+	ErrIncomplete   = errors.New("response incomplete")
+	ErrOverloaded   = errors.New("overloaded, retry later")
+	ErrNotAccepting = errors.New("not accepting registrations right now")
+	ErrTooFarAhead  = errors.New("round too far ahead")
+	ErrRoundAborted = errors.New("round aborted")
+	ErrLastRound    = errors.New("past the server's last round")
+	ErrNotPeer      = errors.New("only other servers may call this")
+)
+
+var rpcErrors = []error{ErrRoundExpired, ErrClusterFull, ErrRateLimited, ErrNotReady, ErrBadBlockSize, ErrDraining, ErrNotEntry, ErrIncomplete, ErrOverloaded, ErrNotAccepting, ErrTooFarAhead, ErrRoundAborted, ErrLastRound, ErrNotPeer}
+
+type remoteError struct {
+	msg string
+	err error
+}
+
+func (e *remoteError) Error() string { return e.msg }
+func (e *remoteError) Unwrap() error { return e.err }
+
+//net/rpc only carries error strings; this maps an error from rpc.Call
+//back onto the sentinels above, so callers can use errors.Is
+func RPCError(err error) error {
+	se, ok := err.(rpc.ServerError)
+	if !ok {
+		return err
+	}
+	msg := string(se)
+	for _, e := range rpcErrors {
+		if msg == e.Error() || strings.HasPrefix(msg, e.Error()+": ") {
+			return &remoteError{msg: msg, err: e}
+		}
+	}
+	return err
+}
+
+//whether it's worth trying the same call again later
+func Retriable(err error) bool {
+	err = RPCError(err)
+	return errors.Is(err, ErrRateLimited) || errors.Is(err, ErrNotReady) ||
+		errors.Is(err, ErrOverloaded) || errors.Is(err, ErrTooFarAhead)
+}
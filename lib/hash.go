@@ -0,0 +1,47 @@
+package lib
+
+import (
+	"fmt"
+	"hash"
+
+	"github.com/dedis/crypto/abstract"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+//hash for block and request hashes: "suite" for the suite's own hash,
+//"sha3" or "blake2b"; every server and client has to agree on it
+var HashFunc = "suite"
+
+func CheckHashFunc(name string) error {
+	switch name {
+	case "suite", "sha3", "blake2b":
+		return nil
+	}
+	return fmt.Errorf("unknown hash %q [suite|sha3|blake2b]", name)
+}
+
+//a fresh HashFunc hash; all choices produce HashSize bytes
+func NewHash(suite abstract.Suite) hash.Hash {
+	switch HashFunc {
+	case "sha3":
+		return sha3.New256()
+	case "blake2b":
+		h, _ := blake2b.New256(nil) //only fails on a bad key
+		return h
+	}
+	return suite.Hash()
+}
+
+//the secretbox key a client's key chunks stand for; a single chunk is
+//used as is
+func KeyFromChunks(chunks [][]byte) []byte {
+	if len(chunks) == 1 {
+		return chunks[0]
+	}
+	h := sha3.New256()
+	for _, c := range chunks {
+		h.Write(c)
+	}
+	return h.Sum(nil)
+}
@@ -1,5 +1,9 @@
 package lib
 
+import (
+	"fmt"
+)
+
 //sizes in bytes
 const HashSize = 32
 const BlockSize = 1024 //1KB for testing; 1MB for production
@@ -8,4 +12,44 @@ const SecretSize = 256 / 8
 
 const MaxRounds = 10
 
+//bytes of a PIR mask over numClients slots: a bit per slot, rounded up
+//past the next whole SecretSize
+func MaskSize(numClients int) int {
+	return (numClients/SecretSize)*SecretSize + SecretSize
+}
+
+//xors go a machine word at a time and silently leave off anything past the
+//last whole word, so blocks, secrets and masks have to be whole words
+func CheckSizes() error {
+	if BlockSize <= 0 || BlockSize%wordSize != 0 {
+		return fmt.Errorf("BlockSize %d isn't a positive multiple of the %d byte words xors work in", BlockSize, wordSize)
+	}
+	if SecretSize <= 0 || SecretSize%wordSize != 0 {
+		return fmt.Errorf("SecretSize %d isn't a positive multiple of the %d byte words xors work in, so masks won't be", SecretSize, wordSize)
+	}
+	return nil
+}
+
 const ServerPort = 8000
+
+//shuffle a fresh set of client keys for every round instead of once at
+//setup, so one round's keys don't open any other round's blocks
+var RoundKeys = false
+
+//points every client key is made of; each is shuffled with its own proof,
+//so more of them spread the key shuffle over more cores
+var KeyChunks = 1
+
+//servers, by id, that only shuffle and turn clients away. there's no taking
+//clients without shuffling: every server in -s is a hop of the shuffle.
+//every server and client has to be given the same ones
+var ShuffleOnly []int
+
+func TakesClients(id int) bool {
+	for _, i := range ShuffleOnly {
+		if i == id {
+			return false
+		}
+	}
+	return true
+}
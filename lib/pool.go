@@ -0,0 +1,36 @@
+package lib
+
+import (
+	"sync"
+)
+
+//reuse BlockSize buffers for the per-client responses every round computes,
+//instead of leaving them all to the garbage collector
+var PoolBlocks = false
+
+var blockPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, BlockSize)
+	},
+}
+
+//a zeroed BlockSize buffer
+func GetBlock() []byte {
+	if !PoolBlocks {
+		return make([]byte, BlockSize)
+	}
+	b := blockPool.Get().([]byte)
+	for i := range b {
+		b[i] = 0
+	}
+	return b
+}
+
+//hands b back for reuse; only once nothing else holds on to it, e.g. an
+//rpc that's still to encode it
+func PutBlock(b []byte) {
+	if !PoolBlocks || cap(b) < BlockSize {
+		return
+	}
+	blockPool.Put(b[:BlockSize])
+}
@@ -0,0 +1,57 @@
+package lib
+
+import (
+	"fmt"
+	"testing"
+)
+
+//a round's responses for 256 clients taken and handed back, with and
+//without PoolBlocks
+func BenchmarkGetBlock(b *testing.B) {
+	const clients = 256
+	for _, pool := range []bool{false, true} {
+		b.Run(fmt.Sprintf("pool=%v", pool), func(b *testing.B) {
+			old := PoolBlocks
+			PoolBlocks = pool
+			defer func() {
+				PoolBlocks = old
+			}()
+			blocks := make([][]byte, clients)
+			b.SetBytes(clients * BlockSize)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for j := range blocks {
+					blocks[j] = GetBlock()
+					blocks[j][0] = byte(j)
+				}
+				for j := range blocks {
+					PutBlock(blocks[j])
+				}
+			}
+		})
+	}
+}
+
+//pooled blocks come back zeroed, whatever was left in them
+func TestGetBlockZeroed(t *testing.T) {
+	old := PoolBlocks
+	PoolBlocks = true
+	defer func() {
+		PoolBlocks = old
+	}()
+	for i := 0; i < 16; i++ {
+		b := GetBlock()
+		for j, x := range b {
+			if x != 0 {
+				t.Fatalf("byte %d of a pooled block is %d", j, x)
+			}
+		}
+		if len(b) != BlockSize {
+			t.Fatalf("pooled block of %d bytes", len(b))
+		}
+		for j := range b {
+			b[j] = 0xff
+		}
+		PutBlock(b)
+	}
+}
@@ -0,0 +1,170 @@
+package lib
+
+import (
+	"crypto/cipher"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/proof"
+	"github.com/dedis/crypto/shuffle"
+)
+
+//applies pi to the ElGamal pairs (X, Y) under h, rerandomizing them, and
+//returns the prover for the shuffle
+func Shuffle(pi []int, group abstract.Group, g, h abstract.Point, X, Y []abstract.Point,
+	rand cipher.Stream) (XX, YY []abstract.Point, P proof.Prover) {
+
+	k := len(X)
+	if k != len(Y) {
+		panic("X,Y vectors have inconsistent length")
+	}
+
+	ps := shuffle.PairShuffle{}
+	ps.Init(group, k)
+
+	// Pick a fresh ElGamal blinding factor for each pair
+	beta := make([]abstract.Scalar, k)
+	for i := 0; i < k; i++ {
+		beta[i] = group.Scalar().Pick(rand)
+	}
+
+	// Create the output pair vectors
+	Xbar := make([]abstract.Point, k)
+	Ybar := make([]abstract.Point, k)
+	for i := 0; i < k; i++ {
+		Xbar[i] = group.Point().Mul(g, beta[pi[i]])
+		Xbar[i].Add(Xbar[i], X[pi[i]])
+		Ybar[i] = group.Point().Mul(h, beta[pi[i]])
+		Ybar[i].Add(Ybar[i], Y[pi[i]])
+	}
+
+	prover := func(ctx proof.ProverContext) error {
+		return ps.Prove(pi, g, h, beta, X, Y, rand, ctx)
+	}
+	return Xbar, Ybar, prover
+}
+
+//checks every shuffle proof in ik against the inputs the shuffling server started from
+func VerifyShuffle(suite abstract.Suite, ik InternalKey, aux AuxKeyProof) error {
+	Xss := aux.OrigXss
+	Yss := aux.OrigYss
+	Xbarss := ik.Xss
+	Ybarss := ik.Ybarss
+	prfss := ik.Proofs
+
+	if len(Yss) != len(Xss) || len(Xbarss) < len(Xss) || len(Ybarss) < len(Xss) ||
+		len(prfss) < len(Xss) || len(ik.Keys) < len(Xss) {
+		return errors.New("Mismatched number of shuffles")
+	}
+
+	for i := range Xss {
+		n := len(Xss[i])
+		if len(Yss[i]) != n || len(Xbarss[i]) != n || len(Ybarss[i]) != n {
+			return fmt.Errorf("Mismatched shuffle length at %d", i)
+		}
+		pk := UnmarshalPoint(suite, ik.Keys[i])
+		Xs := make([]abstract.Point, n)
+		Ys := make([]abstract.Point, n)
+		Xbars := make([]abstract.Point, n)
+		Ybars := make([]abstract.Point, n)
+		for j := range Xss[i] {
+			Xs[j] = UnmarshalPoint(suite, Xss[i][j])
+			Ys[j] = UnmarshalPoint(suite, Yss[i][j])
+			Xbars[j] = UnmarshalPoint(suite, Xbarss[i][j])
+			Ybars[j] = UnmarshalPoint(suite, Ybarss[i][j])
+		}
+		v := shuffle.Verifier(suite, nil, pk, Xs, Ys, Xbars, Ybars)
+		err := proof.HashVerify(suite, "PairShuffle", v, prfss[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//replays every hop's shuffle proof, and checks each hop started from
+//what the previous hop produced
+func VerifyTranscript(suite abstract.Suite, t Transcript) error {
+	return verifyTranscript(suite, t, KeyChunks)
+}
+
+func verifyTranscript(suite abstract.Suite, t Transcript, keyChunks int) error {
+	for i, hop := range t.Hops {
+		if hop.Key.SId != i || hop.Aux.SId != i {
+			return fmt.Errorf("Hop %d is out of order", i)
+		}
+		if i > 0 {
+			prev := t.Hops[i-1].Key
+			if len(prev.Xss) < keyChunks || !equalPoints(hop.Aux.OrigXss, prev.Xss[keyChunks:]) ||
+				!equalPoints(hop.Aux.OrigYss, prev.Yss[keyChunks:]) {
+				return fmt.Errorf("Hop %d didn't start from hop %d's output", i, i-1)
+			}
+		}
+		err := VerifyShuffle(suite, hop.Key, hop.Aux)
+		if err != nil {
+			return fmt.Errorf("Hop %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func equalPoints(a, b [][][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+		for j := range a[i] {
+			if !SliceEquals(a[i][j], b[i][j]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func WriteTranscript(w io.Writer, t Transcript) error {
+	return gob.NewEncoder(w).Encode(t)
+}
+
+func ReadTranscript(r io.Reader) (Transcript, error) {
+	var t Transcript
+	err := gob.NewDecoder(r).Decode(&t)
+	return t, err
+}
+
+//a known good key shuffle, with what it takes to check it again anywhere
+func NewShuffleVector(suite abstract.Suite, t Transcript) ShuffleVector {
+	return ShuffleVector{
+		Suite:      suite.String(),
+		KeyChunks:  KeyChunks,
+		Transcript: t,
+	}
+}
+
+//rechecks a vector written by an earlier build, failing if the proof or
+//point encodings have drifted since
+func VerifyShuffleVector(suite abstract.Suite, v ShuffleVector) error {
+	if v.Suite != suite.String() {
+		return fmt.Errorf("vector is for suite %s, not %s", v.Suite, suite.String())
+	}
+	if len(v.Transcript.Hops) == 0 {
+		return errors.New("vector has no shuffles")
+	}
+	return verifyTranscript(suite, v.Transcript, v.KeyChunks)
+}
+
+func WriteShuffleVector(w io.Writer, v ShuffleVector) error {
+	return gob.NewEncoder(w).Encode(v)
+}
+
+func ReadShuffleVector(r io.Reader) (ShuffleVector, error) {
+	var v ShuffleVector
+	err := gob.NewDecoder(r).Decode(&v)
+	return v, err
+}
@@ -0,0 +1,123 @@
+package lib
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/edwards"
+	"github.com/dedis/crypto/proof"
+	"github.com/dedis/crypto/random"
+)
+
+//one honest shuffle hop of n random pairs, with its proof
+func testShuffle(t *testing.T, suite abstract.Suite, n int) (InternalKey, AuxKeyProof) {
+	sk := suite.Scalar().Pick(random.Stream)
+	pk := suite.Point().Mul(nil, sk)
+
+	X := make([]abstract.Point, n)
+	Y := make([]abstract.Point, n)
+	for i := range X {
+		X[i], _ = suite.Point().Pick(nil, random.Stream)
+		Y[i], _ = suite.Point().Pick(nil, random.Stream)
+	}
+	pi := GeneratePI(n)
+	Xbar, Ybar, prover := Shuffle(pi, suite, nil, pk, X, Y, random.Stream)
+	prf, err := proof.HashProve(suite, "PairShuffle", random.Stream, prover)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	marshal := func(pts []abstract.Point) [][][]byte {
+		bs := make([][]byte, len(pts))
+		for i := range pts {
+			bs[i] = MarshalPoint(pts[i])
+		}
+		return [][][]byte{bs}
+	}
+	ik := InternalKey{
+		Xss:    marshal(Xbar),
+		Ybarss: marshal(Ybar),
+		Proofs: [][]byte{prf},
+		Keys:   [][]byte{MarshalPoint(pk)},
+	}
+	aux := AuxKeyProof{
+		OrigXss: marshal(X),
+		OrigYss: marshal(Y),
+	}
+	return ik, aux
+}
+
+func TestVerifyShuffle(t *testing.T) {
+	suite := edwards.NewAES128SHA256Ed25519(false)
+	ik, aux := testShuffle(t, suite, 8)
+	if err := VerifyShuffle(suite, ik, aux); err != nil {
+		t.Fatal("honest shuffle doesn't verify: ", err)
+	}
+}
+
+func TestVerifyShuffleTamperedYbar(t *testing.T) {
+	suite := edwards.NewAES128SHA256Ed25519(false)
+	ik, aux := testShuffle(t, suite, 8)
+	ik.Ybarss[0][3][0] ^= 1
+	if err := VerifyShuffle(suite, ik, aux); err == nil {
+		t.Fatal("shuffle with a tampered Ybar verifies")
+	}
+}
+
+func TestVerifyShuffleSwappedXbars(t *testing.T) {
+	suite := edwards.NewAES128SHA256Ed25519(false)
+	ik, aux := testShuffle(t, suite, 8)
+	ik.Xss[0][0], ik.Xss[0][1] = ik.Xss[0][1], ik.Xss[0][0]
+	if err := VerifyShuffle(suite, ik, aux); err == nil {
+		t.Fatal("shuffle with swapped Xbars verifies")
+	}
+}
+
+var update = flag.Bool("update", false, "rewrite the vectors in testdata")
+
+var shuffleVector = filepath.Join("testdata", "shuffle.vec")
+
+//the vector in testdata was written by an earlier build; it failing to
+//verify means the proof or point encodings drifted. -update writes a new
+//one, from an honest hop, when that drift is intended
+func TestShuffleVector(t *testing.T) {
+	suite := edwards.NewAES128SHA256Ed25519(false)
+	if *update {
+		ik, aux := testShuffle(t, suite, 8)
+		v := NewShuffleVector(suite, Transcript{Hops: []TranscriptHop{{Key: ik, Aux: aux}}})
+		err := os.MkdirAll("testdata", 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Create(shuffleVector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = WriteShuffleVector(f, v)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f, err := os.Open(shuffleVector)
+	if os.IsNotExist(err) {
+		t.Fatalf("%s is missing, write it with -update", shuffleVector)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	v, err := ReadShuffleVector(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyShuffleVector(suite, v); err != nil {
+		t.Fatal("vector doesn't verify: ", err)
+	}
+}
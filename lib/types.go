@@ -1,5 +1,7 @@
 package lib
 
+import "time"
+
 type File struct {
 	Name            string
 	Hashes          map[string]int64 //maps hash to offset
@@ -10,7 +12,8 @@ type Block struct {
 	Block           []byte
 	Round           uint64
 
-	Id              int //id is only attached in the first submit
+	Id              int    //id is only attached in the first submit
+	Trace           string //client's trace id, logged at each server [optional]
 }
 
 type Request struct {
@@ -18,12 +21,14 @@ type Request struct {
 	Round           uint64
 
 	Id              int
+	Trace           string
 }
 
 type UpKey struct {
 	C1s             [][]byte
 	C2s             [][]byte
 	Id              int
+	Round           uint64 //round the keys are for, with RoundKeys
 }
 
 /////////////////////////////////
@@ -39,11 +44,26 @@ type ClientMask struct {
 	Mask            []byte
 	Id              int
 	Round           uint64
+	WithHashes      bool //also send back the round's upload hashes
+	Trace           string
 }
 
 type ClientRegistration struct {
 	ServerId        int //the dedicated server
 	Id              int
+	Priority        int //how much longer than others a late round waits on it
+}
+
+//registration with a priority; plain Register is priority 0
+type RegisterArgs struct {
+	ServerId        int
+	Priority        int
+}
+
+//the coordinator's view of every registration, see PutClientMap
+type ClientMap struct {
+	Servers         map[int]int //client to dedicated server
+	Priorities      map[int]int //clients with a nonzero priority
 }
 
 type ClientBlock struct {
@@ -65,15 +85,173 @@ type InternalKey struct {
 	Ybarss          [][][]byte
 	Proofs          [][]byte
 	Keys            [][]byte
+	Round           uint64
 }
 
 type AuxKeyProof struct {
 	OrigXss         [][][]byte
 	OrigYss         [][][]byte
 	SId             int
+	Round           uint64
 }
 
 type InternalUpload struct {
 	Blocks          []Block
 	SId             int
 }
+
+type RoundStatus struct {
+	Completed       uint64 //number of rounds finished
+	Highest         uint64 //highest finished round
+	Phases          map[uint64]string //phase of every round in flight
+	ChainErrors     uint64 //mask/secret chains advanced twice or skipped in a round
+	ProofsVerified  uint64 //key shuffle proofs checked out, over the server's lifetime
+	ProofsFailed    uint64 //and didn't; any at all points at a misbehaving peer
+}
+
+type RegStatus struct {
+	Registered      int
+	Expected        int
+	Done            bool //false if the wait timed out first
+}
+
+//blocks handed between servers, optionally compressed
+type BlockBatch struct {
+	Blocks          []Block //set when not compressed
+	Packed          []byte //gzipped gob of the blocks otherwise
+}
+
+//protocol parameters both sides have to agree on
+type Params struct {
+	BlockSize       int
+	SecretSize      int
+	MaxRounds       int
+	Suite           string
+	NumServers      int
+	Hash            string
+	RoundKeys       bool
+	KeyChunks       int
+	ShuffleOnly     string
+}
+
+//one hop of the key shuffle: the shuffling server's output and proofs,
+//and the inputs they're checked against
+type TranscriptHop struct {
+	Key             InternalKey
+	Aux             AuxKeyProof
+}
+
+type Transcript struct {
+	Hops            []TranscriptHop //indexed by the shuffling server's id
+}
+
+//part of an AuxKeyProof: clients [Offset, Offset+len(Xs)) of row Row
+type AuxKeyChunk struct {
+	SId             int
+	Row             int
+	Offset          int
+	Xs              [][]byte
+	Ys              [][]byte
+	Round           uint64
+	Rows            int //shape of the whole proof, so the receiver can allocate it
+	Clients         int
+}
+
+//a server reaching the start of a round, for the round barrier
+type RoundStart struct {
+	Round           uint64
+	SId             int
+}
+
+//what a client learns from registering: its id, and the server its
+//downloads are served by
+type RegisterReply struct {
+	Id              int
+	ServerId        int
+	ServerAddr      string
+}
+
+//fresh Diffie-Hellman points for a registered client's mask and secret
+//chains, which restart from round Round
+type ClientRotation struct {
+	Mask            []byte
+	Secret          []byte
+	Id              int
+	Round           uint64
+}
+
+//the server's halves of a ClientRotation
+type RotationReply struct {
+	Mask            []byte
+	Secret          []byte
+}
+
+//a key shuffle hop that failed to verify, as reported to the auditor
+type Misbehavior struct {
+	Accused         int //server whose shuffle failed
+	Reporter        int //server that caught it
+	Round           uint64
+	Reason          string
+	Proofs          [][]byte //the accused's shuffle proofs, one per row
+}
+
+//a finished round, as sent to -summarysock readers
+type RoundSummary struct {
+	Round           uint64
+	Server          int
+	Clients         int
+	Substituted     int //clients whose blocks were replaced by dummies
+	Padded          int //requests padded in for clients a -reqwindow closed on
+	Aborted         bool
+	Micros          int64 //from the round's first phase to its end
+	Phases          map[string]int64 //microseconds spent in each timed phase
+}
+
+//how busy a server is, for clients choosing where to register
+type LoadInfo struct {
+	Clients         int //clients whose downloads this server serves
+	Rounds          int //rounds in flight
+	Goroutines      int
+	CPUs            int
+	Heap            uint64 //bytes allocated
+}
+
+//a server's GetResponse latency, over all its clients; quantiles are
+//bucket bounds, so good to within a factor of two
+type LatencyStats struct {
+	SId             int
+	Count           uint64
+	P50             time.Duration
+	P99             time.Duration
+}
+
+//a download with what it's made of: Contributions of the Servers'
+//responses went into Block, and the entry server replaced or dropped
+//Substituted blocks of the round it couldn't open and, if it's the first
+//server, Padded requests for clients its -reqwindow closed on
+type RoundResult struct {
+	Block           []byte
+	Round           uint64
+	Contributions   int
+	Servers         int
+	Substituted     int
+	Padded          int
+	//with WithHashes, every slot's upload hash in file sharing mode; all
+	//of them, so the server still can't tell which slot was asked for
+	Hashes          [][]byte
+}
+
+//a key shuffle transcript as a test vector: inputs, outputs and proofs of
+//every hop (the permutations stay secret, the proofs stand in for them)
+type ShuffleVector struct {
+	Suite           string
+	KeyChunks       int
+	Transcript      Transcript
+}
+
+//one server's share of a download from the archive: Mask selects the
+//blocks of round Round to xor, no secret is added
+type ArchiveRequest struct {
+	Round           uint64
+	Mask            []byte
+}
@@ -3,13 +3,20 @@ package lib
 import (
 	"bufio"
 	"bytes"
+	"crypto/cipher"
 	"crypto/rand"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"math/big"
+	"net"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -36,19 +43,26 @@ func AllZero(xs []byte) bool {
 }
 
 func ComputeResponse(allBlocks []Block, mask []byte, secret []byte) []byte {
-	response := make([]byte, BlockSize)
+	return ComputeResponseFunc(len(allBlocks), func(i int) []byte {
+		return allBlocks[i].Block
+	}, mask, secret)
+}
+
+//same as ComputeResponse, for blocks that aren't all in memory
+func ComputeResponseFunc(numBlocks int, block func(int) []byte, mask []byte, secret []byte) []byte {
+	response := GetBlock()
 	i := 0
 L:
 	for _, b := range mask {
 		for j := 0; j < 8; j++ {
+			if i >= numBlocks {
+				break L
+			}
 			if b&1 == 1 {
-				XorWords(response, allBlocks[i].Block[:BlockSize], response)
+				XorWords(response, block(i)[:BlockSize], response)
 			}
 			b >>= 1
 			i++
-			if i >= len(allBlocks) {
-				break L
-			}
 		}
 	}
 	XorWords(response, secret, response)
@@ -68,6 +82,10 @@ func ReverseMap(m map[int]int) map[int][]int {
 }
 
 func GeneratePI(size int) []int {
+	return GeneratePIFrom(size, rand.Reader)
+}
+
+func GeneratePIFrom(size int, random io.Reader) []int {
 	// Pick a random permutation
 	pi := make([]int, size)
 	for i := 0; i < size; i++ { // Initialize a trivial permutation
@@ -75,7 +93,10 @@ func GeneratePI(size int) []int {
 	}
 	for i := size - 1; i > 0; i-- { // Shuffle by random swaps
 		max := big.NewInt(int64(i + 1))
-		jBig, _ := rand.Int(rand.Reader, max)
+		jBig, err := rand.Int(random, max)
+		if err != nil {
+			log.Fatal("Failed reading randomness: ", err)
+		}
 		j := jBig.Int64()
 		if j != int64(i) {
 			t := pi[j]
@@ -86,6 +107,49 @@ func GeneratePI(size int) []int {
 	return pi
 }
 
+//where the servers' permutations come from, for experimenting with ones
+//that aren't uniform; what it returns is checked with CheckPI before use
+type PermutationGenerator interface {
+	Permutation(n int, random io.Reader) ([]int, error)
+}
+
+//GeneratePIFrom, the default
+type UniformPermutation struct{}
+
+func (UniformPermutation) Permutation(n int, random io.Reader) ([]int, error) {
+	return GeneratePIFrom(n, random), nil
+}
+
+//checks pi holds each of 0..n-1 exactly once
+func CheckPI(pi []int, n int) error {
+	if len(pi) != n {
+		return fmt.Errorf("permutation of %d elements, need %d", len(pi), n)
+	}
+	seen := make([]bool, n)
+	for i, p := range pi {
+		if p < 0 || p >= n {
+			return fmt.Errorf("element %d is %d, out of range", i, p)
+		}
+		if seen[p] {
+			return fmt.Errorf("element %d repeats %d", i, p)
+		}
+		seen[p] = true
+	}
+	return nil
+}
+
+//binding commitment to a permutation; salt keeps small pis from being brute forced
+func CommitPI(suite abstract.Suite, salt []byte, pi []int) []byte {
+	h := suite.Hash()
+	h.Write(salt)
+	tmp := make([]byte, 8)
+	for _, p := range pi {
+		binary.BigEndian.PutUint64(tmp, uint64(p))
+		h.Write(tmp)
+	}
+	return h.Sum(nil)
+}
+
 func Encrypt(g abstract.Group, msg []byte, pks []abstract.Point) ([]abstract.Point, []abstract.Point) {
 	c1s := []abstract.Point{}
 	c2s := []abstract.Point{}
@@ -110,8 +174,8 @@ func Encrypt(g abstract.Group, msg []byte, pks []abstract.Point) ([]abstract.Poi
 	return c1s, c2s
 }
 
-func EncryptKey(g abstract.Group, msgPt abstract.Point, pks []abstract.Point) (abstract.Point, abstract.Point) {
-	k := g.Scalar().Pick(random.Stream)
+func EncryptKey(g abstract.Group, msgPt abstract.Point, pks []abstract.Point, rand cipher.Stream) (abstract.Point, abstract.Point) {
+	k := g.Scalar().Pick(rand)
 	c1 := g.Point().Mul(nil, k)
 	var c2 abstract.Point = nil
 	for _, pk := range pks {
@@ -137,6 +201,38 @@ func Decrypt(g abstract.Group, c1 abstract.Point, c2 abstract.Point, sk abstract
 	return g.Point().Sub(c2, g.Point().Mul(c1, sk))
 }
 
+//rejects points that can't be used as key material
+func CheckPoint(g abstract.Group, pt abstract.Point) error {
+	if pt == nil {
+		return errors.New("missing point")
+	}
+	if pt.Equal(g.Point().Null()) {
+		return errors.New("identity point")
+	}
+	return nil
+}
+
+//like UnmarshalPoint, but rejects anything that isn't a point of the prime
+//order group other than the identity (e.g. small subgroup points)
+func UnmarshalValidPoint(suite abstract.Suite, ptByte []byte) (abstract.Point, error) {
+	pt := suite.Point()
+	err := pt.UnmarshalBinary(ptByte)
+	if err != nil {
+		return nil, err
+	}
+	err = CheckPoint(suite, pt)
+	if err != nil {
+		return nil, err
+	}
+	//l*P is the identity exactly when P is in the subgroup of order l
+	minusOne := suite.Scalar().SetInt64(-1)
+	lP := suite.Point().Add(suite.Point().Mul(pt, minusOne), pt)
+	if !lP.Equal(suite.Point().Null()) {
+		return nil, errors.New("point not in the prime order group")
+	}
+	return pt, nil
+}
+
 func Membership(res []byte, set [][]byte) int {
 	for i := range set {
 		same := true
@@ -244,7 +340,7 @@ func NewFile(suite abstract.Suite, path string) (*File, error) {
 		if err != nil {
 			log.Fatal("Failed reading file", err)
 		}
-		h := suite.Hash()
+		h := NewHash(suite)
 		h.Write(tmp)
 		x.Hashes[string(h.Sum(nil))] = int64((i * BlockSize))
 	}
@@ -252,15 +348,144 @@ func NewFile(suite abstract.Suite, path string) (*File, error) {
 	return x, nil
 }
 
+//the parameters this binary was built with
+func LocalParams(suite abstract.Suite, numServers int) Params {
+	return Params{
+		BlockSize:   BlockSize,
+		SecretSize:  SecretSize,
+		MaxRounds:   MaxRounds,
+		Suite:       suite.String(),
+		NumServers:  numServers,
+		Hash:        HashFunc,
+		RoundKeys:   RoundKeys,
+		KeyChunks:   KeyChunks,
+		ShuffleOnly: fmt.Sprint(ShuffleOnly),
+	}
+}
+
+func (p Params) Check(other Params) error {
+	if p != other {
+		return fmt.Errorf("parameter mismatch: have %+v, server has %+v", p, other)
+	}
+	return nil
+}
+
+//comma separated ids of the shuffle-only servers out of numServers, sorted;
+//at least one server has to be left to take clients
+func ParseShuffleOnly(list string, numServers int) ([]int, error) {
+	if list == "" {
+		return nil, nil
+	}
+	ids := []int{}
+	seen := make(map[int]bool)
+	for _, f := range strings.Split(list, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(f))
+		if err != nil {
+			return nil, fmt.Errorf("bad server id %q", f)
+		}
+		if id < 0 || id >= numServers {
+			return nil, fmt.Errorf("server id %d out of range (have %d servers)", id, numServers)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == numServers {
+		return nil, errors.New("no server left to take clients")
+	}
+	sort.Ints(ids)
+	return ids, nil
+}
+
 func ParseServerList(path string) []string {
-	servers, err := ioutil.ReadFile(path)
+	ss, err := ReadServerList(path)
+	if err != nil {
+		log.Fatal("Failed reading servers list: ", err)
+	}
+	return ss
+}
+
+//server list from a file, from stdin if path is "-", or from the
+//comma separated SERVERS environment variable if path is empty
+func ReadServerList(path string) ([]string, error) {
+	var servers []byte
+	var err error
+	switch path {
+	case "":
+		env := os.Getenv("SERVERS")
+		if env == "" {
+			return nil, errors.New("no servers file given and SERVERS not set")
+		}
+		servers = []byte(strings.Replace(env, ",", "\n", -1))
+	case "-":
+		servers, err = ioutil.ReadAll(os.Stdin)
+	default:
+		servers, err = ioutil.ReadFile(path)
+	}
 	if err != nil {
-		log.Fatal("Failed reading servers file:", err)
+		return nil, err
 	}
 	scan := bufio.NewScanner(bytes.NewReader(servers))
 	ss := []string{}
-	for scan.Scan() {
-		ss = append(ss, string(scan.Bytes()))
+	for line := 1; scan.Scan(); line++ {
+		entry := strings.TrimSpace(scan.Text())
+		//trailing newlines and commas leave blank entries
+		if entry == "" {
+			continue
+		}
+		err := checkServerEntry(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server entry on line %d: %v", line, err)
+		}
+		ss = append(ss, entry)
 	}
-	return ss
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+	if len(ss) == 0 {
+		return nil, errors.New("empty servers list")
+	}
+	return ss, nil
+}
+
+//a server list entry has to be host:port, or dialing it fails much later
+func checkServerEntry(entry string) error {
+	if !strings.Contains(entry, ":") {
+		return errors.New("missing port")
+	}
+	host, port, err := net.SplitHostPort(entry)
+	if err != nil {
+		return err
+	}
+	if host == "" {
+		return errors.New("missing host")
+	}
+	if strings.ContainsAny(host, " \t") {
+		return fmt.Errorf("whitespace in host %q", host)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return fmt.Errorf("bad port %q", port)
+	}
+	return nil
+}
+
+//checks outputs hold exactly the inputs, each once, in any order; what a
+//shuffle has to preserve however it permutes
+func CheckPermutation(inputs [][]byte, outputs [][]byte) error {
+	if len(inputs) != len(outputs) {
+		return fmt.Errorf("%d inputs but %d outputs", len(inputs), len(outputs))
+	}
+	count := make(map[string]int)
+	for _, in := range inputs {
+		count[string(in)]++
+	}
+	for i, out := range outputs {
+		if count[string(out)] == 0 {
+			return fmt.Errorf("output %d isn't one of the inputs, or is repeated", i)
+		}
+		count[string(out)]--
+	}
+	return nil
 }
@@ -0,0 +1,51 @@
+package lib
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestReadServerListBlanks(t *testing.T) {
+	old, had := os.LookupEnv("SERVERS")
+	defer func() {
+		if had {
+			os.Setenv("SERVERS", old)
+		} else {
+			os.Unsetenv("SERVERS")
+		}
+	}()
+
+	want := []string{"a:8000", "b:8001"}
+	for _, env := range []string{"a:8000,b:8001,", "a:8000,,b:8001", " a:8000 , b:8001 ,\n"} {
+		os.Setenv("SERVERS", env)
+		ss, err := ReadServerList("")
+		if err != nil {
+			t.Fatalf("%q: %v", env, err)
+		}
+		if !reflect.DeepEqual(ss, want) {
+			t.Fatalf("%q: got %q", env, ss)
+		}
+	}
+	for _, env := range []string{"a:8000,b", ",", "a:0"} {
+		os.Setenv("SERVERS", env)
+		if _, err := ReadServerList(""); err == nil {
+			t.Fatalf("%q: no error", env)
+		}
+	}
+}
+
+func TestParseShuffleOnly(t *testing.T) {
+	ids, err := ParseShuffleOnly("3, 1,3", 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []int{1, 3}) {
+		t.Fatalf("got %v", ids)
+	}
+	for _, list := range []string{"4", "-1", "x", "0,1,2,3"} {
+		if _, err := ParseShuffleOnly(list, 4); err == nil {
+			t.Fatalf("%q: no error", list)
+		}
+	}
+}
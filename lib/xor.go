@@ -6,6 +6,7 @@ package lib
 
 import (
 	"runtime"
+	"sync"
 	"unsafe"
 )
 
@@ -96,6 +97,29 @@ func Xors(as [][]byte) []byte{
 	return dst
 }
 
+//same as Xors, with the bytes split into word aligned ranges across goroutines
+func XorsParallel(as [][]byte, workers int) []byte {
+	n := len(as[0])
+	dst := make([]byte, n)
+	chunk := (n/workers/wordSize + 1) * wordSize
+	var wg sync.WaitGroup
+	for lo := 0; lo < n; lo += chunk {
+		hi := lo + chunk
+		if hi > n {
+			hi = n
+		}
+		wg.Add(1)
+		go func(lo, hi int) {
+			defer wg.Done()
+			for i := range as {
+				XorWords(dst[lo:hi], dst[lo:hi], as[i][lo:hi])
+			}
+		}(lo, hi)
+	}
+	wg.Wait()
+	return dst
+}
+
 func XorsDC(bsss [][][]byte) [][]byte {
 	n := len(bsss)
 	m := len(bsss[0])
@@ -110,3 +134,33 @@ func XorsDC(bsss [][][]byte) [][]byte {
 	}
 	return x
 }
+
+//total bytes above which ReconstructBlock splits the xor across cores.
+//BenchmarkXors does 6-9GB/s on one core, so this much takes ~35us, well
+//past the cost of starting the workers; on a single core
+//BenchmarkXorsParallel only ever loses (30-50%), so it isn't used there
+var ParallelXorThreshold = 1 << 18
+
+//goroutines a large xor is split over [0 for NumCPU], and responses a
+//server computes at once [0 for all of them]
+var XorWorkers = 0
+
+//a downloaded block from the servers' responses: their xor, with mask (the
+//xor of the secrets shared with every server) taken off; a nil mask leaves
+//the secrets in, for a server combining its peers' responses
+func ReconstructBlock(responses [][]byte, mask []byte) []byte {
+	var block []byte
+	workers := XorWorkers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if workers > 1 && len(responses)*len(responses[0]) >= ParallelXorThreshold {
+		block = XorsParallel(responses, workers)
+	} else {
+		block = Xors(responses)
+	}
+	if mask != nil {
+		Xor(mask, block)
+	}
+	return block
+}
@@ -0,0 +1,73 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+func randomBlocks(n, size int) [][]byte {
+	bs := make([][]byte, n)
+	for i := range bs {
+		bs[i] = make([]byte, size)
+		rand.Read(bs[i])
+	}
+	return bs
+}
+
+//serial and parallel xor of responses from 2 to 128 servers, for blocks of
+//1KB (the default BlockSize) to 1MB; ParallelXorThreshold sits where the
+//parallel one starts winning
+func benchmarkXors(b *testing.B, xors func([][]byte) []byte) {
+	for _, size := range []int{1 << 10, 1 << 16, 1 << 20} {
+		for _, servers := range []int{2, 8, 32, 128} {
+			if size*servers > 1<<26 {
+				continue
+			}
+			bs := randomBlocks(servers, size)
+			b.Run(fmt.Sprintf("%dB/%dservers", size, servers), func(b *testing.B) {
+				b.SetBytes(int64(size * servers))
+				for i := 0; i < b.N; i++ {
+					xors(bs)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkXors(b *testing.B) {
+	benchmarkXors(b, Xors)
+}
+
+func BenchmarkXorsParallel(b *testing.B) {
+	benchmarkXors(b, func(bs [][]byte) []byte {
+		return XorsParallel(bs, runtime.NumCPU())
+	})
+}
+
+//ReconstructBlock gives what clients computed before it existed: the xor
+//of the responses, then the mask xored off; above and below the parallel
+//threshold, and with no mask for servers combining responses
+func TestReconstructBlock(t *testing.T) {
+	//split even on one core
+	oldWorkers := XorWorkers
+	XorWorkers = 4
+	defer func() {
+		XorWorkers = oldWorkers
+	}()
+	for _, servers := range []int{1, 3, 300} {
+		responses := randomBlocks(servers, BlockSize)
+		mask := randomBlocks(1, BlockSize)[0]
+
+		want := Xors(responses)
+		if got := ReconstructBlock(responses, nil); !bytes.Equal(got, want) {
+			t.Fatalf("%d servers: unmasked block differs", servers)
+		}
+		Xor(mask, want)
+		if got := ReconstructBlock(responses, mask); !bytes.Equal(got, want) {
+			t.Fatalf("%d servers: masked block differs", servers)
+		}
+	}
+}
@@ -10,7 +10,7 @@ file_dir = sys.argv[4]
 
 gopath = os.environ['GOPATH']
 
-server_cmd = "%s/bin/server -i %d -n %d -s %s/src/github.com/kwonalbert/riffle/servers -m %s -p1 %d"
+server_cmd = "%s/bin/server -i %d -n %d -s %s/src/github.com/kwonalbert/riffle/servers -m %s"
 command = "%s/bin/client -i %d -s %s/src/github.com/kwonalbert/riffle/servers -m %s -w %s -f %s"
 
 server_file = open('%s/src/github.com/kwonalbert/riffle/servers' % gopath, 'w')
@@ -23,7 +23,7 @@ def spawn(c):
 
 ss = []
 for i in range(m):
-    c = server_cmd % (gopath, i, n, gopath, mode, 8000 + i)
+    c = server_cmd % (gopath, i, n, gopath, mode)
     t = threading.Thread(target=spawn, args=(c,))
     ss.append(t)
     t.start()
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"log"
+	"sync"
+
+	. "github.com/kwonalbert/riffle/lib"
+)
+
+//a channel per round that's closed once the round is aborted, for the
+//handlers and rpcs working on it to select on
+type roundAborts struct {
+	lock  *sync.Mutex
+	chans map[uint64]chan bool
+	all   bool //every round, including ones nobody waited on yet
+}
+
+func newRoundAborts() *roundAborts {
+	return &roundAborts{
+		lock:  new(sync.Mutex),
+		chans: make(map[uint64]chan bool),
+	}
+}
+
+func (a *roundAborts) done(round uint64) chan bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	c, ok := a.chans[round]
+	if !ok {
+		c = make(chan bool)
+		if a.all {
+			close(c)
+		}
+		a.chans[round] = c
+	}
+	return c
+}
+
+//aborts every round for good, for a server being torn down
+func (a *roundAborts) abortAll() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.all = true
+	for _, c := range a.chans {
+		select {
+		case <-c:
+		default:
+			close(c)
+		}
+	}
+}
+
+//false if round was already aborted
+func (a *roundAborts) abort(round uint64) bool {
+	c := a.done(round)
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	select {
+	case <-c:
+		return false
+	default:
+		close(c)
+		return true
+	}
+}
+
+func (a *roundAborts) is(round uint64) bool {
+	select {
+	case <-a.done(round):
+		return true
+	default:
+		return false
+	}
+}
+
+//drops the rounds before round, whose slots have been reused since
+func (a *roundAborts) forget(round uint64) {
+	a.lock.Lock()
+	for r := range a.chans {
+		if r < round {
+			delete(a.chans, r)
+		}
+	}
+	a.lock.Unlock()
+}
+
+//closed once round is aborted
+func (s *Server) aborted(round uint64) chan bool {
+	return s.aborts.done(round)
+}
+
+//gives up on round here and on every other server: its handlers unwind,
+//the slot moves on to its next round, and clients waiting on it get
+//ErrRoundAborted. Any server can call it, e.g. when its successor is gone
+func (s *Server) AbortRound(round uint64, _ *int) (err error) {
+	defer recoverRPC("AbortRound", &err)
+	if !s.aborts.abort(round) {
+		return nil
+	}
+	log.Printf("round %d: aborted on server %d", round, s.id)
+	s.round(round % MaxRounds).markAborted(round)
+	s.spawn(func() {
+		err := s.broadcast("Server.AbortRound", round)
+		if err != nil {
+			log.Printf("round %d: couldn't tell everyone it's aborted: %v", round, err)
+		}
+	})
+	return nil
+}
+
+//wakes whoever awaits the slot's phases for round
+func (r *Round) markAborted(round uint64) {
+	r.activeLock.Lock()
+	if round+1 > r.aborted {
+		r.aborted = round + 1
+	}
+	r.activeCond.Broadcast()
+	r.activeLock.Unlock()
+}
+
+//wakes everyone waiting on the slot, for good
+func (r *Round) halt() {
+	r.activeLock.Lock()
+	r.halted = true
+	r.activeCond.Broadcast()
+	r.activeLock.Unlock()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	. "github.com/kwonalbert/riffle/lib" //types and utils
+)
+
+//directory completed rounds' blocks are kept in after their slot is reused,
+//for clients that were offline [empty for none]
+var archiveDir = ""
+
+//one file per round: the record size and count, then fixed size records
+type archive struct {
+	dir string
+	id  int
+}
+
+func newArchive(dir string, id int) (*archive, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &archive{dir: dir, id: id}, nil
+}
+
+func (a *archive) path(round uint64) string {
+	return filepath.Join(a.dir, fmt.Sprintf("server%d-archive%d", a.id, round))
+}
+
+func (a *archive) put(round uint64, blocks []Block) error {
+	size := 0
+	if len(blocks) > 0 {
+		size = len(blocks[0].Block)
+	}
+	buf := make([]byte, 8+len(blocks)*size)
+	binary.BigEndian.PutUint32(buf, uint32(size))
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(blocks)))
+	for i := range blocks {
+		if len(blocks[i].Block) != size {
+			return errors.New("Blocks of a round must all be the same size")
+		}
+		copy(buf[8+i*size:], blocks[i].Block)
+	}
+	//write then rename, so a reader never sees half a round
+	tmp := a.path(round) + ".tmp"
+	err := writeFile(tmp, buf)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path(round))
+}
+
+func writeFile(path string, buf []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+//xor of the archived blocks of round selected by mask
+func (a *archive) response(round uint64, mask []byte) ([]byte, error) {
+	f, err := os.Open(a.path(round))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Round %d isn't archived", round)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, 8)
+	_, err = io.ReadFull(f, header)
+	if err != nil {
+		return nil, err
+	}
+	size := int(binary.BigEndian.Uint32(header))
+	num := int(binary.BigEndian.Uint32(header[4:]))
+	if len(mask)*8 < num {
+		return nil, fmt.Errorf("Mask covers %d blocks, round %d has %d", len(mask)*8, round, num)
+	}
+	b := make([]byte, size)
+	res := ComputeResponseFunc(num, func(i int) []byte {
+		if err != nil {
+			return b
+		}
+		_, err = f.ReadAt(b, int64(8+i*size))
+		return b
+	}, mask, make([]byte, BlockSize))
+	return res, err
+}
+
+//an archived round's blocks xored under the client's mask; the client
+//splits the mask for the block it wants across all servers, so none of
+//them learns which one it was
+func (s *Server) GetArchivedResponse(req *ArchiveRequest, response *[]byte) (err error) {
+	defer recoverRPC("GetArchivedResponse", &err)
+	if s.archive == nil {
+		return errors.New("No archive on this server")
+	}
+	*response, err = s.archive.response(req.Round, req.Mask)
+	return err
+}
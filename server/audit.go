@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	. "github.com/kwonalbert/riffle/lib"
+)
+
+//url misbehavior reports are POSTed to as json [empty for none]
+var auditorURL = ""
+
+const auditTimeout = 10 * time.Second
+
+//tells the auditor ik's shuffle didn't verify, so a cheating server can be
+//named; best effort, a failed report is only logged
+func (s *Server) reportMisbehavior(ik InternalKey, reason error) {
+	if auditorURL == "" {
+		return
+	}
+	m := Misbehavior{
+		Accused:  ik.SId,
+		Reporter: s.id,
+		Round:    ik.Round,
+		Reason:   reason.Error(),
+		Proofs:   ik.Proofs,
+	}
+	go func() {
+		err := postReport(m)
+		if err != nil {
+			log.Println("Couldn't report misbehavior of server", m.Accused, ":", err)
+		}
+	}()
+}
+
+func postReport(m Misbehavior) error {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	client := http.Client{Timeout: auditTimeout}
+	resp, err := client.Post(auditorURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("auditor answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+
+	. "github.com/kwonalbert/riffle/lib"
+)
+
+//how many peers the aux proof is sent to at once, and how many clients'
+//keys go in each chunk; both bound how much is being encoded at a time
+var auxConcurrency = 4
+var auxChunkSize = 1024
+
+//an aux proof being put back together from its chunks
+type auxAssembly struct {
+	aux    AuxKeyProof
+	got    map[[2]int]bool
+	filled int
+}
+
+//sends aux to every peer, a chunk at a time
+func (s *Server) sendAuxProof(aux AuxKeyProof) error {
+	size := auxChunkSize
+	if size <= 0 {
+		size = s.totalClients
+	}
+	rows := len(aux.OrigXss)
+	chunks := []AuxKeyChunk{}
+	for row := 0; row < rows; row++ {
+		for off := 0; off < s.totalClients; off += size {
+			end := off + size
+			if end > s.totalClients {
+				end = s.totalClients
+			}
+			chunks = append(chunks, AuxKeyChunk{
+				SId:     aux.SId,
+				Row:     row,
+				Offset:  off,
+				Xs:      aux.OrigXss[row][off:end],
+				Ys:      aux.OrigYss[row][off:end],
+				Round:   aux.Round,
+				Rows:    rows,
+				Clients: s.totalClients,
+			})
+		}
+	}
+	return s.fanOut("Server.PutAuxChunk", auxConcurrency, func(i int) error {
+		for c := range chunks {
+			err := s.callPeer(i, "Server.PutAuxChunk", &chunks[c], nil)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Server) PutAuxChunk(chunk *AuxKeyChunk, _ *int) (err error) {
+	defer recoverRPC("PutAuxChunk", &err)
+	if chunk.SId < 0 || chunk.SId >= len(s.servers) {
+		return fmt.Errorf("Aux proof from unknown server %d", chunk.SId)
+	}
+	//the shape is what the key shuffle has at that hop, not whatever the
+	//sender claims, so it can't make us allocate more
+	if chunk.Rows != (len(s.servers)-chunk.SId)*KeyChunks || chunk.Clients != s.totalClients {
+		return fmt.Errorf("Aux proof chunk from server %d has the wrong shape", chunk.SId)
+	}
+	if chunk.Row < 0 || chunk.Row >= chunk.Rows || chunk.Offset < 0 ||
+		len(chunk.Xs) != len(chunk.Ys) || chunk.Offset+len(chunk.Xs) > chunk.Clients {
+		return fmt.Errorf("Bad aux proof chunk from server %d", chunk.SId)
+	}
+
+	ks := s.keyShuffle(chunk.Round)
+	ks.auxLock.Lock()
+	defer ks.auxLock.Unlock()
+	a := ks.auxParts[chunk.SId]
+	if a == nil {
+		a = &auxAssembly{
+			aux: AuxKeyProof{
+				OrigXss: make([][][]byte, chunk.Rows),
+				OrigYss: make([][][]byte, chunk.Rows),
+				SId:     chunk.SId,
+				Round:   chunk.Round,
+			},
+			got: make(map[[2]int]bool),
+		}
+		for i := range a.aux.OrigXss {
+			a.aux.OrigXss[i] = make([][]byte, chunk.Clients)
+			a.aux.OrigYss[i] = make([][]byte, chunk.Clients)
+		}
+		ks.auxParts[chunk.SId] = a
+	}
+	if len(a.aux.OrigXss) != chunk.Rows || len(a.aux.OrigXss[0]) != chunk.Clients {
+		return fmt.Errorf("Aux proof chunk from server %d changed shape", chunk.SId)
+	}
+	//retries can deliver the same chunk twice
+	key := [2]int{chunk.Row, chunk.Offset}
+	if a.got[key] {
+		return nil
+	}
+	a.got[key] = true
+	copy(a.aux.OrigXss[chunk.Row][chunk.Offset:], chunk.Xs)
+	copy(a.aux.OrigYss[chunk.Row][chunk.Offset:], chunk.Ys)
+	a.filled += len(chunk.Xs)
+
+	if a.filled == chunk.Rows*chunk.Clients {
+		delete(ks.auxParts, chunk.SId)
+		ks.auxProofChan[chunk.SId] <- a.aux
+	}
+	return nil
+}
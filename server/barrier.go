@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	. "github.com/kwonalbert/riffle/lib"
+)
+
+//hold every round until all servers have reached it, so no server starts
+//gathering a round well before the others
+var roundBarrier = false
+
+//servers that have reached a round, and a channel closed once all have
+type roundStart struct {
+	got   map[int]bool
+	ready chan bool
+}
+
+type barrier struct {
+	lock   *sync.Mutex
+	rounds map[uint64]*roundStart
+}
+
+func newBarrier() *barrier {
+	return &barrier{
+		lock:   new(sync.Mutex),
+		rounds: make(map[uint64]*roundStart),
+	}
+}
+
+//the caller must hold b.lock
+func (b *barrier) get(round uint64) *roundStart {
+	rs := b.rounds[round]
+	if rs == nil {
+		rs = &roundStart{
+			got:   make(map[int]bool),
+			ready: make(chan bool),
+		}
+		b.rounds[round] = rs
+	}
+	return rs
+}
+
+//closes ready once every server that isn't down has arrived;
+//the caller must hold s.barrier.lock
+func (s *Server) checkBarrier(rs *roundStart) {
+	for i := range s.servers {
+		if !rs.got[i] && !s.degraded.is(i) {
+			return
+		}
+	}
+	select {
+	case <-rs.ready:
+	default:
+		close(rs.ready)
+	}
+}
+
+//tells everyone this server reached round, and waits until they all have
+func (s *Server) startRound(round uint64) {
+	if !roundBarrier {
+		return
+	}
+	t := time.Now()
+	err := s.broadcast("Server.StartRound", &RoundStart{Round: round, SId: s.id})
+	if err != nil {
+		log.Printf("round %d: barrier: %v", round, err)
+	}
+
+	s.barrier.lock.Lock()
+	rs := s.barrier.get(round)
+	s.checkBarrier(rs)
+	s.barrier.lock.Unlock()
+
+	select {
+	case <-rs.ready:
+	case <-s.ctx.Done():
+	}
+	s.barrier.lock.Lock()
+	delete(s.barrier.rounds, round)
+	s.barrier.lock.Unlock()
+	s.logTiming(round, "barrier", time.Since(t))
+}
+
+func (s *Server) StartRound(start *RoundStart, _ *int) (err error) {
+	defer recoverRPC("StartRound", &err)
+	if start.SId < 0 || start.SId >= len(s.servers) {
+		return fmt.Errorf("Round start from unknown server %d", start.SId)
+	}
+	s.barrier.lock.Lock()
+	defer s.barrier.lock.Unlock()
+	rs := s.barrier.get(start.Round)
+	rs.got[start.SId] = true
+	s.checkBarrier(rs)
+	return nil
+}
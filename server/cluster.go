@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+//n servers in one process that reach each other over in-memory pipes
+//instead of sockets, to try out topologies too big to spawn processes for.
+//they share the package settings (TotalClients, the topology, ...) as
+//servers in different processes would have to agree on them anyway, and
+//dialPeer is pointed at the cluster until Stop, so there can only be one
+//at a time
+type Cluster struct {
+	Servers []*Server
+
+	addrs    map[string]int
+	oldDial  func(string) (caller, error)
+	oldSelf  bool
+	errs     chan error
+	wg       sync.WaitGroup
+	stopOnce sync.Once
+}
+
+//the address server i goes by in the cluster; it's never dialed for real
+func clusterAddr(i int) string {
+	return fmt.Sprintf("cluster-%d", i)
+}
+
+func NewCluster(ctx context.Context, n int, FSMode bool) *Cluster {
+	c := &Cluster{
+		Servers: make([]*Server, n),
+		addrs:   make(map[string]int),
+		oldDial: dialPeer,
+		oldSelf: inProcessSelf,
+		errs:    make(chan error, n),
+	}
+	addrs := make([]string, n)
+	for i := range addrs {
+		addrs[i] = clusterAddr(i)
+		c.addrs[addrs[i]] = i
+	}
+	for i := range c.Servers {
+		c.Servers[i] = NewServerContext(ctx, 0, i, addrs, FSMode)
+	}
+	dialPeer = c.dial
+	inProcessSelf = true
+	return c
+}
+
+func (c *Cluster) dial(addr string) (caller, error) {
+	i, ok := c.addrs[addr]
+	if !ok {
+		return nil, fmt.Errorf("No server %s in the cluster", addr)
+	}
+	return c.Servers[i].dialPipe("cluster"), nil
+}
+
+//a connection to server i for a client of the cluster
+func (c *Cluster) Dial(i int) caller {
+	return c.Servers[i].dialPipe("client")
+}
+
+//connects the servers and gets their handlers waiting on registration,
+//which clients do through Dial like they would over the network
+func (c *Cluster) Start() {
+	for _, s := range c.Servers {
+		c.wg.Add(1)
+		go func(s *Server) {
+			defer c.wg.Done()
+			err := s.run()
+			if err != nil {
+				c.errs <- fmt.Errorf("server %d: %v", s.id, err)
+			}
+		}(s)
+	}
+}
+
+//resets every server, then starts them again on a new scenario; clients
+//have to Dial again
+func (c *Cluster) Reset() {
+	for _, s := range c.Servers {
+		s.cancel()
+	}
+	c.wg.Wait()
+	for len(c.errs) > 0 {
+		<-c.errs
+	}
+	for _, s := range c.Servers {
+		s.Reset()
+	}
+	c.Start()
+}
+
+//waits for every server to be done with maxTotalRounds rounds, or for the
+//first one to fail
+func (c *Cluster) Wait() error {
+	for _, s := range c.Servers {
+		select {
+		case <-s.finished:
+		case <-s.Failed():
+			return fmt.Errorf("server %d failed: %v", s.id, s.Err())
+		case err := <-c.errs:
+			return err
+		}
+	}
+	return nil
+}
+
+//stops every server and hands dialPeer back
+func (c *Cluster) Stop() {
+	c.stopOnce.Do(func() {
+		for _, s := range c.Servers {
+			s.Stop()
+		}
+		c.wg.Wait()
+		dialPeer = c.oldDial
+		inProcessSelf = c.oldSelf
+	})
+}
@@ -0,0 +1,603 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+
+	. "github.com/kwonalbert/riffle/lib"
+
+	"github.com/dedis/crypto/abstract"
+	"github.com/dedis/crypto/edwards"
+	"github.com/dedis/crypto/random"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/sha3"
+)
+
+//just enough of a microblogging client to drive a Cluster
+type testClient struct {
+	id     int
+	server int //where its blocks go and come back from
+	conns  []caller
+	suite  abstract.Suite
+	pks    []abstract.Point
+	keys   [][]byte
+	//per round slot and server, as the servers keep them for this client
+	maskss   [][][]byte
+	secretss [][][]byte
+}
+
+func newTestClient(t *testing.T, c *Cluster, server int) *testClient {
+	tc := &testClient{
+		server: server,
+		conns:  make([]caller, len(c.Servers)),
+		suite:  edwards.NewAES128SHA256Ed25519(false),
+		pks:    make([]abstract.Point, len(c.Servers)),
+		keys:   make([][]byte, len(c.Servers)),
+	}
+	for i := range tc.conns {
+		tc.conns[i] = c.Dial(i)
+		var pk []byte
+		err := tc.conns[i].Call("Server.GetPK", 0, &pk)
+		if err != nil {
+			t.Fatal("Couldn't get server's pk: ", err)
+		}
+		tc.pks[i] = UnmarshalPoint(tc.suite, pk)
+	}
+	return tc
+}
+
+//registers with server 0; the last client only gets an answer once every
+//server runs rounds
+func (tc *testClient) register() error {
+	var reply RegisterReply
+	err := tc.conns[0].Call("Server.Register", tc.server, &reply)
+	if err != nil {
+		return err
+	}
+	tc.id = reply.Id
+	return nil
+}
+
+//what the real client does between registering and its first round
+func (tc *testClient) setup() error {
+	var n int
+	err := tc.conns[0].Call("Server.GetNumClients", 0, &n)
+	if err != nil {
+		return err
+	}
+	tc.maskss = make([][][]byte, MaxRounds)
+	tc.secretss = make([][][]byte, MaxRounds)
+	for r := range tc.maskss {
+		tc.maskss[r] = make([][]byte, len(tc.conns))
+		tc.secretss[r] = make([][]byte, len(tc.conns))
+		for k := range tc.maskss[r] {
+			tc.maskss[r][k] = make([]byte, MaskSize(n))
+			tc.secretss[r][k] = make([]byte, BlockSize)
+		}
+	}
+	gen := tc.suite.Point().Base()
+	for k, conn := range tc.conns {
+		for method, chains := range map[string][][][]byte{"Server.ShareMask": tc.maskss, "Server.ShareSecret": tc.secretss} {
+			secret := tc.suite.Scalar().Pick(random.Stream)
+			dh := ClientDH{
+				Public: MarshalPoint(tc.suite.Point().Mul(gen, secret)),
+				Id:     tc.id,
+			}
+			var pub []byte
+			err = conn.Call(method, &dh, &pub)
+			if err != nil {
+				return err
+			}
+			shared := tc.suite.Point().Mul(UnmarshalPoint(tc.suite, pub), secret)
+			seedChain(chains, k, MarshalPoint(shared), 0)
+		}
+	}
+	return tc.uploadKeys(0)
+}
+
+//fresh keys, for every round or with RoundKeys for round's
+func (tc *testClient) uploadKeys(round uint64) error {
+	n := len(tc.conns)
+	upkey := UpKey{
+		C1s:   make([][]byte, n*KeyChunks),
+		C2s:   make([][]byte, n*KeyChunks),
+		Id:    tc.id,
+		Round: round,
+	}
+	gen := tc.suite.Point().Base()
+	for i := range tc.conns {
+		chunks := make([][]byte, KeyChunks)
+		for k := range chunks {
+			public := tc.suite.Point().Mul(gen, tc.suite.Scalar().Pick(random.Stream))
+			chunks[k] = MarshalPoint(public)
+			c1, c2 := EncryptKey(tc.suite, public, tc.pks[:i+1], random.Stream)
+			upkey.C1s[i*KeyChunks+k] = MarshalPoint(c1)
+			upkey.C2s[i*KeyChunks+k] = MarshalPoint(c2)
+		}
+		tc.keys[i] = KeyFromChunks(chunks)
+	}
+	err := tc.conns[0].Call("Server.UploadKeys", &upkey, nil)
+	if err != nil {
+		return err
+	}
+	return tc.conns[0].Call("Server.KeyReady", &RequestArg{Id: tc.id, Round: round}, nil)
+}
+
+func (tc *testClient) seal(msg []byte, round uint64) []byte {
+	tmp := make([]byte, 24)
+	binary.PutUvarint(tmp, round)
+	nonce := [24]byte{}
+	copy(nonce[:], tmp)
+	for i := len(tc.keys) - 1; i >= 0; i-- {
+		key := [32]byte{}
+		copy(key[:], tc.keys[i])
+		msg = secretbox.Seal(nil, msg, &nonce, &key)
+	}
+	return msg
+}
+
+func (tc *testClient) upload(round uint64, block []byte) error {
+	b := Block{Block: tc.seal(block, round), Round: round, Id: tc.id}
+	return tc.conns[tc.server].Call("Server.UploadSmall", &b, nil)
+}
+
+func (tc *testClient) downloadAll(round uint64) ([][]byte, error) {
+	var blocks [][]byte
+	err := tc.conns[tc.server].Call("Server.GetAllResponses", &RequestArg{Id: tc.id, Round: round}, &blocks)
+	return blocks, err
+}
+
+//file sharing: asks for the block hashing to hash, and gets what every
+//client asked for
+func (tc *testClient) request(round uint64, hash []byte) ([][]byte, error) {
+	req := Request{Hash: tc.seal(hash, round), Round: round, Id: tc.id}
+	var hashes [][]byte
+	err := tc.conns[tc.server].Call("Server.RequestBlock", &req, &hashes)
+	return hashes, err
+}
+
+//file sharing: uploads block along with its hash, and gets every upload's
+//hash
+func (tc *testClient) uploadBlock(round uint64, block []byte, hash []byte) ([][]byte, error) {
+	msg := append(append([]byte{}, block...), hash...)
+	b := Block{Block: tc.seal(msg, round), Round: round, Id: tc.id}
+	var hashes [][]byte
+	err := tc.conns[tc.server].Call("Server.UploadBlock", &b, &hashes)
+	return hashes, err
+}
+
+//file sharing: slot's block of round, without any server learning which
+func (tc *testClient) downloadSlot(round uint64, slot int) ([]byte, error) {
+	rnd := round % MaxRounds
+	mask := Xors(tc.maskss[rnd])
+	Xor(tc.maskss[rnd][tc.server], mask)
+	want := make([]byte, len(mask))
+	SetBit(slot, true, want)
+	Xor(want, mask)
+	var res RoundResult
+	cmask := ClientMask{Mask: mask, Id: tc.id, Round: round}
+	err := tc.conns[tc.server].Call("Server.GetRoundResult", cmask, &res)
+	if err != nil {
+		return nil, err
+	}
+	block := ReconstructBlock([][]byte{res.Block}, Xors(tc.secretss[rnd]))
+	for k := range tc.maskss[rnd] {
+		sha3.ShakeSum256(tc.maskss[rnd][k], tc.maskss[rnd][k])
+		sha3.ShakeSum256(tc.secretss[rnd][k], tc.secretss[rnd][k])
+	}
+	return block, nil
+}
+
+//starts a microblogging cluster of servers, with clients spread over them
+//registered and holding their shuffled keys; everything is stopped and the
+//package settings put back when t ends
+func startCluster(t *testing.T, servers int, clients int, rounds uint64) (*Cluster, []*testClient) {
+	c := newTestCluster(t, servers, clients, rounds, false)
+	c.Start()
+	return c, joinClients(t, c, clients)
+}
+
+//a cluster for clients, not started yet
+func newTestCluster(t *testing.T, servers int, clients int, rounds uint64, FSMode bool) *Cluster {
+	oldTotal, oldRounds := TotalClients, maxTotalRounds
+	TotalClients, maxTotalRounds = clients, rounds
+	c := NewCluster(context.Background(), servers, FSMode)
+	t.Cleanup(func() {
+		c.Stop()
+		TotalClients, maxTotalRounds = oldTotal, oldRounds
+	})
+	return c
+}
+
+//clients spread over c's servers, registered and holding their shuffled keys
+func joinClients(t *testing.T, c *Cluster, clients int) []*testClient {
+	tcs := make([]*testClient, clients)
+	for i := range tcs {
+		tcs[i] = newTestClient(t, c, i%len(c.Servers))
+	}
+	each(t, tcs, func(tc *testClient) error {
+		return tc.register()
+	})
+	each(t, tcs, func(tc *testClient) error {
+		return tc.setup()
+	})
+	return tcs
+}
+
+//runs f for every client at once, failing t if any of them fails
+func each(t *testing.T, tcs []*testClient, f func(*testClient) error) {
+	errs := make([]error, len(tcs))
+	var wg sync.WaitGroup
+	for i := range tcs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = f(tcs[i])
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+	}
+}
+
+//every client uploads a random block for round; returns the blocks in
+//client order and what client 0 downloaded, after checking every client
+//downloaded the same
+func runRound(t *testing.T, tcs []*testClient, round uint64) ([][]byte, [][]byte) {
+	in := make([][]byte, len(tcs))
+	for i := range in {
+		in[i] = make([]byte, BlockSize)
+		random.Stream.XORKeyStream(in[i], in[i])
+	}
+	each(t, tcs, func(tc *testClient) error {
+		return tc.upload(round, in[tc.id-clientIdBase])
+	})
+	outs := make([][][]byte, len(tcs))
+	each(t, tcs, func(tc *testClient) error {
+		var err error
+		outs[tc.id-clientIdBase], err = tc.downloadAll(round)
+		return err
+	})
+	for i := range outs {
+		for j := range outs[i] {
+			if !bytes.Equal(outs[i][j], outs[0][j]) {
+				t.Fatalf("round %d: client %d downloaded a different slot %d", round, i, j)
+			}
+		}
+	}
+	return in, outs[0]
+}
+
+//where each input ended up in out, failing t unless out holds every
+//input exactly once
+func matchOutputs(t *testing.T, in [][]byte, out [][]byte) []int {
+	if len(out) != len(in) {
+		t.Fatalf("%d outputs for %d inputs", len(out), len(in))
+	}
+	where := make([]int, len(in))
+	used := make([]bool, len(out))
+	for i := range in {
+		where[i] = -1
+		for j := range out {
+			if !used[j] && bytes.Equal(in[i], out[j]) {
+				where[i] = j
+				used[j] = true
+				break
+			}
+		}
+		if where[i] == -1 {
+			t.Fatalf("input %d isn't in the output", i)
+		}
+	}
+	return where
+}
+
+func TestClusterRounds(t *testing.T) {
+	const rounds = 3
+	c, tcs := startCluster(t, 10, 4, rounds)
+	for r := uint64(0); r < rounds; r++ {
+		in, out := runRound(t, tcs, r)
+		matchOutputs(t, in, out)
+	}
+	err := c.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+//the same rounds with every server keeping its blocks on disk, which is
+//where downloads are then served from
+func TestClusterRoundsOnDisk(t *testing.T) {
+	const rounds = 3
+	c := newTestCluster(t, 3, 4, rounds, false)
+	dir := t.TempDir()
+	stores := make([]*diskStore, len(c.Servers))
+	for k, s := range c.Servers {
+		var err error
+		stores[k], err = newDiskStore(dir, k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.store = stores[k]
+	}
+	c.Start()
+	tcs := joinClients(t, c, 4)
+	for r := uint64(0); r < rounds; r++ {
+		in, out := runRound(t, tcs, r)
+		matchOutputs(t, in, out)
+	}
+	err := c.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, d := range stores {
+		info, err := d.files[0].Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() < int64(4*BlockSize) {
+			t.Fatalf("server %d wrote %d bytes for round 0", k, info.Size())
+		}
+	}
+}
+
+//outputs of a round over several servers are the inputs, each once, but
+//in an order none of the servers' own permutations explains: only all of
+//them applied in turn do
+func TestUnlinkability(t *testing.T) {
+	oldDebug := debug
+	debug = true
+	defer func() {
+		debug = oldDebug
+	}()
+	const clients = 16
+	c, tcs := startCluster(t, 3, clients, 1)
+	in, out := runRound(t, tcs, 0)
+	err := CheckPermutation(in, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//server k puts its input's slot pi[j] in slot j, so output slot j came
+	//from pi_0[pi_1[...pi_n-1[j]]]
+	pis := make([][]int, len(c.Servers))
+	for k, s := range c.Servers {
+		pis[k], err = s.ExportPermutation()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for j := range out {
+		src := j
+		for k := len(pis) - 1; k >= 0; k-- {
+			src = pis[k][src]
+		}
+		if !bytes.Equal(out[j], in[src]) {
+			t.Fatalf("output %d isn't input %d, where the servers' permutations put it", j, src)
+		}
+	}
+	for k, pi := range pis {
+		explains := true
+		for j := range out {
+			explains = explains && bytes.Equal(out[j], in[pi[j]])
+		}
+		if explains {
+			t.Fatalf("server %d's permutation alone links inputs to outputs", k)
+		}
+	}
+}
+
+//a client deregistering with every server leaves nothing of its masks and
+//secrets on any of them, for any round slot, and the others' untouched
+func TestDeregisterWipes(t *testing.T) {
+	c, tcs := startCluster(t, 3, 4, 2)
+	in, out := runRound(t, tcs, 0)
+	matchOutputs(t, in, out)
+
+	gone := tcs[1]
+	for k, conn := range gone.conns {
+		err := conn.Call("Server.Deregister", gone.id, nil)
+		if err != nil {
+			t.Fatalf("deregistering from server %d: %v", k, err)
+		}
+	}
+
+	allZero := func(b []byte) bool {
+		for _, x := range b {
+			if x != 0 {
+				return false
+			}
+		}
+		return true
+	}
+	i := gone.id - clientIdBase
+	for k, s := range c.Servers {
+		s.chainLock.Lock()
+		for r := range s.maskss {
+			if !allZero(s.maskss[r][i]) || !allZero(s.secretss[r][i]) {
+				t.Errorf("server %d: slot %d still has client %d's chains", k, r, gone.id)
+			}
+			for j := range s.maskss[r] {
+				if j != i && allZero(s.secretss[r][j]) {
+					t.Errorf("server %d: slot %d lost client %d's secret", k, r, j+clientIdBase)
+				}
+			}
+		}
+		s.chainLock.Unlock()
+	}
+}
+
+//with -debug, the permutations the servers export are the ones they
+//applied: over two servers, output slot j holds input pi_0[pi_1[j]]; and
+//without it, nothing is exported
+func TestExportPermutation(t *testing.T) {
+	oldDebug := debug
+	defer func() {
+		debug = oldDebug
+	}()
+	debug = true
+	const clients = 8
+	c, tcs := startCluster(t, 2, clients, 1)
+	in, out := runRound(t, tcs, 0)
+
+	pis := make([][]int, len(c.Servers))
+	for k, s := range c.Servers {
+		pi, err := s.ExportPermutation()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen := make([]bool, clients)
+		for _, p := range pi {
+			if p < 0 || p >= clients || seen[p] {
+				t.Fatalf("server %d exported %v, not a permutation of %d", k, pi, clients)
+			}
+			seen[p] = true
+		}
+		pis[k] = pi
+	}
+	for j := range out {
+		if !bytes.Equal(out[j], in[pis[0][pis[1][j]]]) {
+			t.Fatalf("output %d isn't input %d, where the exported permutations put it", j, pis[0][pis[1][j]])
+		}
+	}
+
+	debug = false
+	if _, err := c.Servers[0].ExportPermutation(); err == nil {
+		t.Fatal("permutation exported without -debug")
+	}
+}
+
+//two scenarios on the same servers, with a different number of clients:
+//after Reset the servers keep their keys but nothing else, and the second
+//scenario runs as if on a new cluster
+func TestReset(t *testing.T) {
+	c, tcs := startCluster(t, 3, 4, 1)
+	in, out := runRound(t, tcs, 0)
+	matchOutputs(t, in, out)
+	pks := make([][]byte, len(c.Servers))
+	for k, s := range c.Servers {
+		pks[k] = s.pkBin
+	}
+
+	TotalClients = 6
+	c.Reset()
+	for k, s := range c.Servers {
+		if s.totalClients != 0 || s.pi != nil || s.maskss != nil {
+			t.Fatalf("server %d kept its clients", k)
+		}
+		if !bytes.Equal(s.pkBin, pks[k]) {
+			t.Fatalf("server %d has a new key", k)
+		}
+	}
+	tcs = joinClients(t, c, 6)
+	in, out = runRound(t, tcs, 0)
+	matchOutputs(t, in, out)
+	err := c.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+//with RoundKeys, every round's blocks are sealed under keys shuffled for
+//it alone: each round opens, and no slot's keys on any server are another
+//round's
+func TestRoundKeys(t *testing.T) {
+	oldKeys := RoundKeys
+	RoundKeys = true
+	defer func() {
+		RoundKeys = oldKeys
+	}()
+	const rounds = 2
+	c, tcs := startCluster(t, 3, 4, rounds)
+	for r := uint64(0); r < rounds; r++ {
+		if r > 0 {
+			each(t, tcs, func(tc *testClient) error {
+				return tc.uploadKeys(r)
+			})
+		}
+		in, out := runRound(t, tcs, r)
+		matchOutputs(t, in, out)
+	}
+	for k, s := range c.Servers {
+		keys0, keys1 := s.keyShuffle(0).keys, s.keyShuffle(1).keys
+		for j := range keys0 {
+			if bytes.Equal(keys0[j], keys1[j]) {
+				t.Fatalf("server %d: slot %d has the same key in rounds 0 and 1", k, j)
+			}
+		}
+	}
+}
+
+//a file sharing round with every server and client hashing with BLAKE2b:
+//each client asks for the next one's block by its hash and gets it, and
+//every server published the same upload hashes, BLAKE2b's
+func TestFileSharingBlake2b(t *testing.T) {
+	oldHash := HashFunc
+	HashFunc = "blake2b"
+	defer func() {
+		HashFunc = oldHash
+	}()
+	const clients = 4
+	c := newTestCluster(t, 3, clients, 1, true)
+	c.Start()
+	tcs := joinClients(t, c, clients)
+
+	files := make([][]byte, clients)
+	hashes := make([][]byte, clients)
+	for i := range files {
+		files[i] = make([]byte, BlockSize)
+		random.Stream.XORKeyStream(files[i], files[i])
+		h := NewHash(tcs[0].suite)
+		h.Write(files[i])
+		hashes[i] = h.Sum(nil)
+		sum := blake2b.Sum256(files[i])
+		if !bytes.Equal(hashes[i], sum[:]) {
+			t.Fatal("NewHash isn't BLAKE2b")
+		}
+	}
+	wanted := func(tc *testClient) int {
+		return (tc.id - clientIdBase + 1) % clients
+	}
+	each(t, tcs, func(tc *testClient) error {
+		reqs, err := tc.request(0, hashes[wanted(tc)])
+		if err == nil && Membership(hashes[tc.id-clientIdBase], reqs) == -1 {
+			err = fmt.Errorf("nobody asked for its block")
+		}
+		return err
+	})
+	ups := make([][][]byte, clients)
+	each(t, tcs, func(tc *testClient) error {
+		i := tc.id - clientIdBase
+		var err error
+		ups[i], err = tc.uploadBlock(0, files[i], hashes[i])
+		return err
+	})
+	each(t, tcs, func(tc *testClient) error {
+		slot := Membership(hashes[wanted(tc)], ups[tc.id-clientIdBase])
+		if slot == -1 {
+			return fmt.Errorf("block %d wasn't uploaded", wanted(tc))
+		}
+		block, err := tc.downloadSlot(0, slot)
+		if err == nil && !bytes.Equal(block[:BlockSize], files[wanted(tc)]) {
+			err = fmt.Errorf("slot %d isn't block %d", slot, wanted(tc))
+		}
+		return err
+	})
+	for k, s := range c.Servers {
+		published := s.round(0).upHashes
+		for j := range published {
+			if !bytes.Equal(published[j], c.Servers[0].round(0).upHashes[j]) {
+				t.Fatalf("server %d published a different hash for slot %d", k, j)
+			}
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+)
+
+//codec this server asks its peers for: "gob" (net/rpc's own) or "binary",
+//which frames messages itself and encodes the key shuffle types flat.
+//Clients and peers that don't ask get gob
+var rpcCodec = "gob"
+
+//gob never sends an empty message, so no gob stream starts with a 0
+const codecMagic = 0
+
+func checkCodec(name string) error {
+	switch name {
+	case "gob", "binary":
+		return nil
+	}
+	return fmt.Errorf("unknown codec %q [gob|binary]", name)
+}
+
+//a connection whose first bytes were already read into r
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func writeCodecName(w io.Writer, name string) error {
+	_, err := w.Write(append([]byte{byte(len(name))}, name...))
+	return err
+}
+
+func readCodecName(r io.Reader) (string, error) {
+	n := make([]byte, 1)
+	_, err := io.ReadFull(r, n)
+	if err != nil {
+		return "", err
+	}
+	name := make([]byte, n[0])
+	_, err = io.ReadFull(r, name)
+	return string(name), err
+}
+
+//serves conn with the codec the other end asks for, or gob if it
+//doesn't ask or asks for one this server doesn't know
+func serveCodec(rpcServer *rpc.Server, conn net.Conn) {
+	bc := &bufConn{Conn: conn, r: bufio.NewReader(conn)}
+	first, err := bc.r.Peek(1)
+	if err != nil || first[0] != codecMagic {
+		rpcServer.ServeConn(limitConn(bc, messageLimit()))
+		return
+	}
+	bc.r.ReadByte()
+	name, err := readCodecName(bc.r)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if checkCodec(name) != nil {
+		name = "gob"
+	}
+	err = writeCodecName(conn, name)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	if name == "binary" {
+		rpcServer.ServeCodec(newBinaryCodec(bc))
+	} else {
+		rpcServer.ServeConn(limitConn(bc, messageLimit()))
+	}
+}
+
+//dials addr and asks for rpcCodec, settling for what the server agrees to
+func dialCodec(addr string) (*rpc.Client, error) {
+	if rpcCodec == "gob" {
+		return rpc.Dial("tcp", addr)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write([]byte{codecMagic})
+	if err == nil {
+		err = writeCodecName(conn, rpcCodec)
+	}
+	var name string
+	if err == nil {
+		name, err = readCodecName(conn)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if name == "binary" {
+		return rpc.NewClientWithCodec(newBinaryCodec(conn)), nil
+	}
+	return rpc.NewClient(conn), nil
+}
+
+//both ends of the "binary" codec: every header and body is its own frame,
+//a uvarint length and then the bytes. Bodies with MarshalBinary are sent
+//as that, anything else as a standalone gob
+type binaryCodec struct {
+	rwc io.ReadWriteCloser
+	r   *bufio.Reader
+	w   *bufio.Writer
+}
+
+func newBinaryCodec(rwc io.ReadWriteCloser) *binaryCodec {
+	return &binaryCodec{
+		rwc: rwc,
+		r:   bufio.NewReader(rwc),
+		w:   bufio.NewWriter(rwc),
+	}
+}
+
+func (c *binaryCodec) writeFrame(b []byte) error {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(tmp, uint64(len(b)))
+	_, err := c.w.Write(tmp[:n])
+	if err != nil {
+		return err
+	}
+	_, err = c.w.Write(b)
+	return err
+}
+
+//like limitConn for gob, refuses a frame over messageLimit before
+//allocating it
+func (c *binaryCodec) readFrame() ([]byte, error) {
+	n, err := binary.ReadUvarint(c.r)
+	if err != nil {
+		return nil, err
+	}
+	max := messageLimit()
+	if max > 0 && n > uint64(max) {
+		return nil, fmt.Errorf("Message of %d bytes is over the %d byte limit", n, max)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(c.r, b)
+	return b, err
+}
+
+func (c *binaryCodec) writeMessage(header []byte, body interface{}) error {
+	var b []byte
+	var err error
+	if m, ok := body.(encoding.BinaryMarshaler); ok {
+		b, err = m.MarshalBinary()
+	} else {
+		var buf bytes.Buffer
+		err = gob.NewEncoder(&buf).Encode(body)
+		b = buf.Bytes()
+	}
+	if err != nil {
+		return err
+	}
+	err = c.writeFrame(header)
+	if err == nil {
+		err = c.writeFrame(b)
+	}
+	if err == nil {
+		err = c.w.Flush()
+	}
+	return err
+}
+
+func (c *binaryCodec) readBody(body interface{}) error {
+	b, err := c.readFrame()
+	if err != nil || body == nil {
+		return err
+	}
+	if u, ok := body.(encoding.BinaryUnmarshaler); ok {
+		return u.UnmarshalBinary(b)
+	}
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(body)
+}
+
+var errBadHeader = errors.New("binary codec: bad header")
+
+func putString(b []byte, s string) []byte {
+	b = putUint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func putUint(b []byte, x uint64) []byte {
+	tmp := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(tmp, x)
+	return append(b, tmp[:n]...)
+}
+
+func getUint(b []byte) (uint64, []byte, error) {
+	x, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, errBadHeader
+	}
+	return x, b[n:], nil
+}
+
+func getString(b []byte) (string, []byte, error) {
+	n, b, err := getUint(b)
+	if err != nil || n > uint64(len(b)) {
+		return "", nil, errBadHeader
+	}
+	return string(b[:n]), b[n:], nil
+}
+
+func (c *binaryCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	header := putString(nil, r.ServiceMethod)
+	header = putUint(header, r.Seq)
+	return c.writeMessage(header, body)
+}
+
+func (c *binaryCodec) ReadRequestHeader(r *rpc.Request) error {
+	b, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	r.ServiceMethod, b, err = getString(b)
+	if err != nil {
+		return err
+	}
+	r.Seq, _, err = getUint(b)
+	return err
+}
+
+func (c *binaryCodec) ReadRequestBody(body interface{}) error {
+	return c.readBody(body)
+}
+
+func (c *binaryCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	header := putString(nil, r.ServiceMethod)
+	header = putUint(header, r.Seq)
+	header = putString(header, r.Error)
+	return c.writeMessage(header, body)
+}
+
+func (c *binaryCodec) ReadResponseHeader(r *rpc.Response) error {
+	b, err := c.readFrame()
+	if err != nil {
+		return err
+	}
+	r.ServiceMethod, b, err = getString(b)
+	if err != nil {
+		return err
+	}
+	r.Seq, b, err = getUint(b)
+	if err != nil {
+		return err
+	}
+	r.Error, _, err = getString(b)
+	return err
+}
+
+func (c *binaryCodec) ReadResponseBody(body interface{}) error {
+	return c.readBody(body)
+}
+
+func (c *binaryCodec) Close() error {
+	return c.rwc.Close()
+}
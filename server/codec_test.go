@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"fmt"
+	"net"
+	"net/rpc"
+	"testing"
+
+	. "github.com/kwonalbert/riffle/lib"
+)
+
+//takes key shuffle messages and drops them, so a call is all encoding,
+//transport and decoding
+type sink struct{}
+
+func (sink) ShareServerKeys(ik *InternalKey, correct *bool) error {
+	*correct = true
+	return nil
+}
+
+func (sink) PutClientBlock(cblock ClientBlock, _ *int) error {
+	return nil
+}
+
+//a hop's InternalKey for 3 servers: every row full of points and
+//ciphertexts, plus a proof per row
+func benchKey(clients int) *InternalKey {
+	grid := func(rows int) [][][]byte {
+		g := make([][][]byte, rows)
+		for i := range g {
+			g[i] = make([][]byte, clients)
+			for j := range g[i] {
+				g[i][j] = make([]byte, SecretSize)
+				rand.Read(g[i][j])
+			}
+		}
+		return g
+	}
+	ik := &InternalKey{
+		Xss:    grid(3),
+		Yss:    grid(3),
+		Ybarss: grid(3),
+		Proofs: make([][]byte, 3),
+		Keys:   make([][]byte, 3),
+	}
+	for i := range ik.Proofs {
+		ik.Proofs[i] = make([]byte, clients*8*SecretSize)
+		ik.Keys[i] = make([]byte, SecretSize)
+	}
+	return ik
+}
+
+//sends key shuffle messages over an in-memory connection, coded by codec
+func benchmarkCodec(b *testing.B, codec string) {
+	for _, clients := range []int{64, 1024} {
+		b.Run(fmt.Sprintf("%dclients", clients), func(b *testing.B) {
+			sc, cc := net.Pipe()
+			rpcServer := rpc.NewServer()
+			rpcServer.RegisterName("Server", sink{})
+			var client *rpc.Client
+			if codec == "binary" {
+				go rpcServer.ServeCodec(newBinaryCodec(sc))
+				client = rpc.NewClientWithCodec(newBinaryCodec(cc))
+			} else {
+				go rpcServer.ServeConn(sc)
+				client = rpc.NewClient(cc)
+			}
+			defer client.Close()
+
+			ik := benchKey(clients)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				var correct bool
+				err := client.Call("Server.ShareServerKeys", ik, &correct)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkCodecGob(b *testing.B) {
+	benchmarkCodec(b, "gob")
+}
+
+func BenchmarkCodecBinary(b *testing.B) {
+	benchmarkCodec(b, "binary")
+}
+
+//InternalKey's fields without its MarshalBinary, the way gob used to
+//encode it by reflection
+type reflectedKey struct {
+	Xss    [][][]byte
+	Yss    [][][]byte
+	SId    int
+	Ybarss [][][]byte
+	Proofs [][]byte
+	Keys   [][]byte
+	Round  uint64
+}
+
+//encoding and decoding a hop's InternalKey by gob reflection, against the
+//flat encoding both codecs now use for it
+func BenchmarkKeyEncoding(b *testing.B) {
+	for _, clients := range []int{64, 1024} {
+		ik := benchKey(clients)
+		b.Run(fmt.Sprintf("reflect/%dclients", clients), func(b *testing.B) {
+			rk := reflectedKey(*ik)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var buf bytes.Buffer
+				err := gob.NewEncoder(&buf).Encode(&rk)
+				if err == nil {
+					err = gob.NewDecoder(&buf).Decode(&reflectedKey{})
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("flat/%dclients", clients), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				data, err := ik.MarshalBinary()
+				if err == nil {
+					err = new(InternalKey).UnmarshalBinary(data)
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+//a round's fan-out of client blocks to one peer, from many goroutines at
+//once, over a pool of 1 and of 4 loopback tcp connections
+func BenchmarkPeerPool(b *testing.B) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+	rpcServer := rpc.NewServer()
+	rpcServer.RegisterName("Server", sink{})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go rpcServer.ServeConn(conn)
+		}
+	}()
+
+	for _, n := range []int{1, 4} {
+		b.Run(fmt.Sprintf("%dconns", n), func(b *testing.B) {
+			pool, err := dialPool(n, func() (caller, error) {
+				return rpc.Dial("tcp", l.Addr().String())
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer closePeers([]caller{pool})
+
+			cblock := ClientBlock{Block: Block{Block: make([]byte, BlockSize)}}
+			b.SetBytes(BlockSize)
+			b.SetParallelism(16)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					err := pool.Call("Server.PutClientBlock", cblock, nil)
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+//without -maxmsg, a batch of every client's block and a key shuffle hop
+//over every client both fit under the limit, however big blocks are
+func TestMessageLimit(t *testing.T) {
+	oldTotal, oldMax := TotalClients, maxMessageSize
+	defer func() { TotalClients, maxMessageSize = oldTotal, oldMax }()
+	TotalClients = 2000
+	maxMessageSize = -1
+
+	batch := BlockBatch{Blocks: make([]Block, TotalClients)}
+	for i := range batch.Blocks {
+		batch.Blocks[i] = Block{Block: make([]byte, BlockSize+HashSize), Round: 1 << 40, Id: i}
+	}
+	for name, msg := range map[string]interface{}{"blocks": &batch, "keys": benchKey(TotalClients)} {
+		var buf bytes.Buffer
+		err := gob.NewEncoder(&buf).Encode(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if int64(buf.Len()) > messageLimit() {
+			t.Errorf("%s: %d bytes over the %d byte limit", name, buf.Len(), messageLimit())
+		}
+	}
+
+	maxMessageSize = 4096
+	if messageLimit() != 4096 {
+		t.Fatalf("-maxmsg 4096 gave a limit of %d", messageLimit())
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime"
+	"sync"
+)
+
+//the first error that stops the server after Start: the accept loop
+//failing, or a round handler panicking. it cancels everything else, so the
+//server shuts down as a whole instead of running on with parts missing
+type failure struct {
+	once *sync.Once
+	done chan bool //closed on the first failure
+	err  error
+}
+
+func newFailure() *failure {
+	return &failure{
+		once: new(sync.Once),
+		done: make(chan bool),
+	}
+}
+
+func (s *Server) fail(err error) {
+	s.failure.once.Do(func() {
+		s.failure.err = err
+		log.Printf("server %d: stopping: %v", s.id, err)
+		close(s.failure.done)
+		s.cancel()
+	})
+}
+
+//closed once the server has failed, with the root cause from Err
+func (s *Server) Failed() <-chan bool {
+	return s.failure.done
+}
+
+func (s *Server) Err() error {
+	select {
+	case <-s.failure.done:
+		return s.failure.err
+	default:
+		return nil
+	}
+}
+
+//like recoverRPC, for the round handlers, where there's no caller to hand
+//the error to
+func (s *Server) recoverHandler(round uint64) {
+	if r := recover(); r != nil {
+		stack := make([]byte, 64<<10)
+		stack = stack[:runtime.Stack(stack, false)]
+		log.Printf("round %d: handler panicked: %v\n%s", round, r, stack)
+		s.fail(fmt.Errorf("round %d: handler panicked: %v", round, r))
+	}
+}
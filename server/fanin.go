@@ -0,0 +1,57 @@
+package main
+
+//how many servers' xors of a client's response are combined at once
+//[0 for all of them at the client's server]; with fewer, the servers form
+//a tree under the client's server, each xoring in its children's share
+//before passing it up, so no server takes more than xorFanIn of them
+var xorFanIn = 0
+
+func (s *Server) fanIn() int {
+	n := len(s.servers)
+	if xorFanIn <= 0 || xorFanIn > n-1 {
+		return n - 1
+	}
+	return xorFanIn
+}
+
+//positions in client's tree count from its server, in server id order
+func (s *Server) treePos(client int) int {
+	n := len(s.servers)
+	return (s.id - s.clientMap[client] + n) % n
+}
+
+func (s *Server) treeServer(client int, pos int) int {
+	return (pos + s.clientMap[client]) % len(s.servers)
+}
+
+//the server this one hands its share of client's response to
+func (s *Server) xorParent(client int) int {
+	return s.treeServer(client, (s.treePos(client)-1)/s.fanIn())
+}
+
+//the servers whose shares of client's response come to this one
+func (s *Server) xorChildren(client int) []int {
+	k := s.fanIn()
+	pos := s.treePos(client)
+	children := []int{}
+	for c := pos*k + 1; c <= pos*k+k && c < len(s.servers); c++ {
+		children = append(children, s.treeServer(client, c))
+	}
+	return children
+}
+
+//how many servers' shares are xored into the one from server sid
+func (s *Server) subtreeSize(client int, sid int) int {
+	n := len(s.servers)
+	k := s.fanIn()
+	pos := (sid - s.clientMap[client] + n) % n
+	size := 0
+	//one level of the subtree at a time
+	for lo, hi := pos, pos; lo < n; lo, hi = lo*k+1, hi*k+k {
+		if hi > n-1 {
+			hi = n - 1
+		}
+		size += hi - lo + 1
+	}
+	return size
+}
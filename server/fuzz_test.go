@@ -0,0 +1,133 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/kwonalbert/riffle/lib"
+)
+
+//server 1 of 3, registered with 4 clients, for rounds 0 to MaxRounds-1,
+//all of which are aborted so calls that get through the checks return
+func fuzzServer(t *testing.T) *Server {
+	oldRounds := maxTotalRounds
+	maxTotalRounds = MaxRounds
+	t.Cleanup(func() {
+		maxTotalRounds = oldRounds
+	})
+	s := registeredServer(t, 1, 3, 4)
+	for r := uint64(0); r < MaxRounds; r++ {
+		s.aborts.abort(r)
+	}
+	return s
+}
+
+//fails t if call panicked, which recoverRPC turns into a "method failed"
+//error; a call still waiting after a while took a well formed message
+//and is left to it
+func noPanic(t *testing.T, method string, call func() error) {
+	done := make(chan error, 1)
+	go func() {
+		done <- call()
+	}()
+	select {
+	case err := <-done:
+		if err != nil && strings.HasPrefix(err.Error(), method+" failed: ") {
+			t.Fatal(err)
+		}
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+//data cut into n pieces
+func pieces(data []byte, n int) [][]byte {
+	ps := make([][]byte, n)
+	for i := range ps {
+		ps[i] = data[i*len(data)/n : (i+1)*len(data)/n]
+	}
+	return ps
+}
+
+//data cut into rows of cols pieces
+func grid(data []byte, rows, cols int) [][][]byte {
+	g := make([][][]byte, rows)
+	for i, row := range pieces(data, rows) {
+		g[i] = pieces(row, cols)
+	}
+	return g
+}
+
+func FuzzPutAuxChunk(f *testing.F) {
+	f.Add(0, 0, 0, uint64(0), 3, 4, uint8(4), uint8(4), make([]byte, 8*SecretSize))
+	f.Add(2, 1, 2, uint64(3), 1, 4, uint8(2), uint8(2), make([]byte, 4*SecretSize))
+	f.Add(1, -1, 5, uint64(1), 1<<30, 1<<30, uint8(1), uint8(0), []byte{})
+	f.Fuzz(func(t *testing.T, sid, row, off int, round uint64, rows, clients int, nx, ny uint8, data []byte) {
+		s := fuzzServer(t)
+		chunk := AuxKeyChunk{
+			SId:     sid,
+			Row:     row,
+			Offset:  off,
+			Xs:      pieces(data, int(nx)),
+			Ys:      pieces(data, int(ny)),
+			Round:   round,
+			Rows:    rows,
+			Clients: clients,
+		}
+		noPanic(t, "PutAuxChunk", func() error {
+			return s.PutAuxChunk(&chunk, nil)
+		})
+	})
+}
+
+func FuzzShareServerKeys(f *testing.F) {
+	f.Add(0, uint64(0), uint8(3), uint8(4), uint8(3), uint8(1), make([]byte, 12*SecretSize))
+	f.Add(2, uint64(1), uint8(1), uint8(4), uint8(0), uint8(0), make([]byte, 4*SecretSize))
+	f.Add(-1, uint64(9), uint8(0), uint8(0), uint8(1), uint8(3), []byte{1, 2, 3})
+	f.Fuzz(func(t *testing.T, sid int, round uint64, rows, cols, nproofs, nkeys uint8, data []byte) {
+		s := fuzzServer(t)
+		ik := InternalKey{
+			Xss:    grid(data, int(rows), int(cols)),
+			Yss:    grid(data, int(rows), int(cols)),
+			SId:    sid,
+			Ybarss: grid(data, int(rows), int(cols)),
+			Proofs: pieces(data, int(nproofs)),
+			Keys:   pieces(data, int(nkeys)),
+			Round:  round,
+		}
+		var correct bool
+		noPanic(t, "ShareServerKeys", func() error {
+			return s.ShareServerKeys(&ik, &correct)
+		})
+	})
+}
+
+func FuzzUploadBlock2(f *testing.F) {
+	f.Add(0, uint64(0), make([]byte, BlockSize))
+	f.Add(3, uint64(5), []byte{})
+	f.Add(-1, uint64(1<<63), []byte{1})
+	f.Fuzz(func(t *testing.T, id int, round uint64, data []byte) {
+		s := fuzzServer(t)
+		block := Block{Block: data, Round: round, Id: id}
+		noPanic(t, "UploadBlock2", func() error {
+			return s.UploadBlock2(&block, nil)
+		})
+	})
+}
+
+func FuzzPutClientBlock(f *testing.F) {
+	f.Add(0, 0, uint64(0), make([]byte, BlockSize))
+	f.Add(3, 2, uint64(7), []byte{})
+	f.Add(4, 3, uint64(1<<63), []byte{1})
+	f.Fuzz(func(t *testing.T, cid, sid int, round uint64, data []byte) {
+		s := fuzzServer(t)
+		cblock := ClientBlock{
+			CId:   cid,
+			SId:   sid,
+			Block: Block{Block: data, Round: round},
+		}
+		noPanic(t, "PutClientBlock", func() error {
+			return s.PutClientBlock(cblock, nil)
+		})
+	})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	. "github.com/kwonalbert/riffle/lib"
+)
+
+//how long a key shuffle waits on missing key uploads before reporting
+//them [0 for no limit], and then what it does: keep waiting, abort the
+//round (or exit, for the setup shuffle), or fill them in with dummy keys
+var keyWait time.Duration = 0
+var missingKeys = "wait"
+
+//state of one key shuffle: the one at setup, or with RoundKeys, the one
+//each round runs for its own keys
+type keyShuffle struct {
+	keys           [][]byte //clients' keys for this server, in shuffled order
+	keysRdy        chan bool
+	auxProofChan   []chan AuxKeyProof
+	auxParts       map[int]*auxAssembly //aux proofs still arriving, by server
+	auxLock        *sync.Mutex
+	keyUploadChan  chan UpKey
+	keyShuffleChan chan InternalKey //collect all uploads together
+	transcript     Transcript       //every hop of the key shuffle, for auditors
+	transcriptLock *sync.Mutex
+}
+
+func newKeyShuffle(numClients int, numServers int) *keyShuffle {
+	ks := keyShuffle{
+		keys:           make([][]byte, numClients),
+		keysRdy:        make(chan bool, numClients),
+		auxProofChan:   make([]chan AuxKeyProof, numServers),
+		auxParts:       make(map[int]*auxAssembly),
+		auxLock:        new(sync.Mutex),
+		keyUploadChan:  make(chan UpKey, numClients),
+		keyShuffleChan: make(chan InternalKey),
+		transcript:     Transcript{Hops: make([]TranscriptHop, numServers)},
+		transcriptLock: new(sync.Mutex),
+	}
+	for i := range ks.auxProofChan {
+		ks.auxProofChan[i] = make(chan AuxKeyProof, numServers)
+	}
+	return &ks
+}
+
+//the key shuffle round's blocks are sealed under; waits for registration,
+//since that's when it knows how many clients there are
+func (s *Server) keyShuffle(round uint64) *keyShuffle {
+	<-s.regReady
+	if RoundKeys {
+		return s.round(round % MaxRounds).keyShuffle
+	}
+	return s.setupKeys
+}
+
+//how many key shuffles run side by side
+func keyRounds() uint64 {
+	if RoundKeys {
+		return MaxRounds
+	}
+	return 1
+}
+
+//every client's uploaded keys, by client; reports whoever is missing every
+//keyWait, and gives up (returning false) if the round is aborted
+func (s *Server) gatherKeyUploads(ks *keyShuffle, round uint64) ([]UpKey, bool) {
+	allKeys := make([]UpKey, s.totalClients)
+	got := make([]bool, s.totalClients)
+	start := time.Now()
+	var timeout <-chan time.Time
+	if keyWait > 0 {
+		timeout = time.After(keyWait)
+	}
+	for n := 0; n < s.totalClients; {
+		select {
+		case key := <-ks.keyUploadChan:
+			if got[key.Id] {
+				log.Printf("round %d: client %d uploaded keys twice", round, key.Id+clientIdBase)
+				continue
+			}
+			allKeys[key.Id] = key
+			got[key.Id] = true
+			n++
+		case <-timeout:
+			for i := range got {
+				if !got[i] {
+					log.Printf("round %d: waiting on key from client %d for %v",
+						round, i+clientIdBase, time.Since(start).Round(time.Second))
+				}
+			}
+			switch missingKeys {
+			case "abort":
+				if !RoundKeys {
+					log.Fatalf("round %d: giving up on the key shuffle", round)
+				}
+				s.AbortRound(round, nil)
+				return nil, false
+			case "dummy":
+				for i := range got {
+					if !got[i] {
+						allKeys[i] = s.dummyKey(i, round)
+					}
+				}
+				return allKeys, true
+			}
+			timeout = time.After(keyWait)
+		case <-s.aborted(round):
+			return nil, false
+		case <-s.ctx.Done():
+			return nil, false
+		}
+	}
+	return allKeys, true
+}
+
+//keys nobody knows, for a client that never uploaded its own; encrypted
+//the way a client would, so the shuffle and its proofs go through as usual
+func (s *Server) dummyKey(i int, round uint64) UpKey {
+	key := UpKey{
+		C1s:   make([][]byte, len(s.servers)*KeyChunks),
+		C2s:   make([][]byte, len(s.servers)*KeyChunks),
+		Id:    i,
+		Round: round,
+	}
+	rand := s.newRand()
+	for j := range s.servers {
+		for k := 0; k < KeyChunks; k++ {
+			pt, _ := s.g.Point().Pick(nil, rand)
+			row := j*KeyChunks + k
+			c1, c2 := EncryptKey(s.g, pt, s.pks[:j+1], rand)
+			key.C1s[row] = MarshalPoint(c1)
+			key.C2s[row] = MarshalPoint(c2)
+		}
+	}
+	return key
+}
+
+func checkMissingKeys(mode string) error {
+	switch mode {
+	case "wait", "abort", "dummy":
+		return nil
+	}
+	return fmt.Errorf("-missingkeys must be wait, abort or dummy, not %q", mode)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	. "github.com/kwonalbert/riffle/lib"
+)
+
+//bucket i counts latencies under 2^i microseconds (the last, everything
+//longer); about a minute at the top, which is coarse but plenty for p50/p99
+const latencyBuckets = 27
+
+type latencyHistogram struct {
+	lock    *sync.Mutex
+	buckets [latencyBuckets]uint64
+	count   uint64
+}
+
+func newLatencyHistogram() *latencyHistogram {
+	return &latencyHistogram{lock: new(sync.Mutex)}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	us := d.Nanoseconds() / 1000
+	i := 0
+	for i < latencyBuckets-1 && us >= 1<<uint(i) {
+		i++
+	}
+	h.lock.Lock()
+	h.buckets[i]++
+	h.count++
+	h.lock.Unlock()
+}
+
+//upper bound of the bucket the q quantile falls in; lock must be held
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	need := uint64(q*float64(h.count) + 0.5)
+	if need == 0 {
+		need = 1
+	}
+	var seen uint64 = 0
+	for i, n := range h.buckets {
+		seen += n
+		if seen >= need {
+			return time.Duration(1<<uint(i)) * time.Microsecond
+		}
+	}
+	return time.Duration(1<<uint(latencyBuckets-1)) * time.Microsecond
+}
+
+//GetResponse latency over every client this server answered
+func (s *Server) GetLatency(_ int, stats *LatencyStats) (err error) {
+	defer recoverRPC("GetLatency", &err)
+	h := s.respLatency
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	stats.SId = s.id
+	stats.Count = h.count
+	stats.P50 = h.quantile(0.5)
+	stats.P99 = h.quantile(0.99)
+	return nil
+}
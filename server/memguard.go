@@ -0,0 +1,83 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	. "github.com/kwonalbert/riffle/lib"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+//heap size past which no new rounds are taken on [0 for no limit]
+var memHighWater uint64 = 0
+
+//rounds this entry server let clients start, and the heap size last seen;
+//reading it stops the world, so it's refreshed at most every memRefresh
+type memGuard struct {
+	lock     *sync.Mutex
+	admitted map[uint64]bool
+	heap     uint64
+	read     time.Time
+}
+
+const memRefresh = 100 * time.Millisecond
+
+func newMemGuard() *memGuard {
+	return &memGuard{
+		lock:     new(sync.Mutex),
+		admitted: make(map[uint64]bool),
+	}
+}
+
+//rough bytes one round holds: every client's upload as gathered, as
+//shuffled, and as stored for downloads
+func (s *Server) roundMemory() uint64 {
+	return 3 * uint64(s.totalClients) * uint64(BlockSize+len(s.servers)*secretbox.Overhead)
+}
+
+//whether clients may start round; rounds already under way always go on,
+//a new one only if it fits under memHighWater
+func (s *Server) admitRound(round uint64) error {
+	if memHighWater == 0 {
+		return nil
+	}
+	g := s.mem
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.admitted[round] {
+		return nil
+	}
+	g.refresh()
+	if g.heap+s.roundMemory() > memHighWater {
+		return ErrOverloaded
+	}
+	g.admitted[round] = true
+	//count it against the limit until the next reading
+	g.heap += s.roundMemory()
+	return nil
+}
+
+//rereads the heap size if the last reading is stale; lock must be held
+func (g *memGuard) refresh() {
+	if time.Since(g.read) > memRefresh {
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		g.heap = m.HeapAlloc
+		g.read = time.Now()
+	}
+}
+
+//the heap size, at most memRefresh old
+func (s *Server) heapSize() uint64 {
+	s.mem.lock.Lock()
+	defer s.mem.lock.Unlock()
+	s.mem.refresh()
+	return s.mem.heap
+}
+
+func (s *Server) releaseRound(round uint64) {
+	s.mem.lock.Lock()
+	delete(s.mem.admitted, round)
+	s.mem.lock.Unlock()
+}
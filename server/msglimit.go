@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+
+	. "github.com/kwonalbert/riffle/lib" //types and utils
+)
+
+//largest gob message a peer or client may send [0 for no limit, -1 for
+//messageLimit to size it from the round]
+var maxMessageSize int64 = -1
+
+//room per client in a batch for what isn't its block: ids, round, gob
+//framing, and its share of the key shuffle per key chunk
+const clientOverhead = 256
+const keyChunkOverhead = 4096
+
+//room in any message for what isn't per client
+const messageOverhead = 1 << 20
+
+//the largest message accepted: -maxmsg if it's set, otherwise enough for
+//the biggest thing servers send each other, a batch of every client's
+//block with its hash, or a key shuffle over every client's key
+func messageLimit() int64 {
+	if maxMessageSize >= 0 {
+		return maxMessageSize
+	}
+	perClient := int64(BlockSize+HashSize+clientOverhead) + int64(KeyChunks)*keyChunkOverhead
+	return int64(TotalClients)*perClient + messageOverhead
+}
+
+//a connection that checks the length prefix of every incoming gob message
+//and fails the read if it's over max; gob allocates the whole message
+//before reading it, so this has to happen before the decoder sees it
+type limitedConn struct {
+	net.Conn
+	max  uint64
+	left uint64 //bytes left in the current message
+	hdr  []byte //length prefix not yet handed to the decoder
+}
+
+func limitConn(conn net.Conn, max int64) net.Conn {
+	if max <= 0 {
+		return conn
+	}
+	return &limitedConn{Conn: conn, max: uint64(max)}
+}
+
+func (c *limitedConn) Read(p []byte) (int, error) {
+	if len(c.hdr) == 0 && c.left == 0 {
+		err := c.readHeader()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(c.hdr) > 0 {
+		n := copy(p, c.hdr)
+		c.hdr = c.hdr[n:]
+		return n, nil
+	}
+	if uint64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.Conn.Read(p)
+	c.left -= uint64(n)
+	return n, err
+}
+
+//a gob message starts with its length as a gob uint: one byte below 128,
+//otherwise the negated byte count followed by that many big endian bytes
+func (c *limitedConn) readHeader() error {
+	b := make([]byte, 1)
+	_, err := io.ReadFull(c.Conn, b)
+	if err != nil {
+		return err
+	}
+	hdr := b
+	n := uint64(b[0])
+	if b[0] >= 128 {
+		l := int(-int8(b[0]))
+		if l > 8 {
+			return fmt.Errorf("Bad message length prefix from %v", c.RemoteAddr())
+		}
+		buf := make([]byte, l)
+		_, err = io.ReadFull(c.Conn, buf)
+		if err != nil {
+			return err
+		}
+		n = 0
+		for _, x := range buf {
+			n = n<<8 | uint64(x)
+		}
+		hdr = append(hdr, buf...)
+	}
+	if n > c.max {
+		err = fmt.Errorf("Message of %d bytes from %v is over the %d byte limit", n, c.RemoteAddr(), c.max)
+		log.Println(err)
+		return err
+	}
+	c.left = n
+	c.hdr = hdr
+	return nil
+}
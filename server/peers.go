@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//what the server needs from a connection to a peer; *rpc.Client is one,
+//tests can swap in their own through dialPeer
+type caller interface {
+	Call(method string, args interface{}, reply interface{}) error
+}
+
+//closes the connections that can be; nil entries were never dialed
+func closePeers(peers []caller) {
+	for _, p := range peers {
+		if c, ok := p.(io.Closer); ok {
+			c.Close()
+		}
+	}
+}
+
+var dialPeer = func(addr string) (caller, error) {
+	c, err := dialCodec(addr)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+//connections kept to each peer; net/rpc writes one call at a time to a
+//connection, so a round's parallel calls to a peer queue up behind each
+//other on just one. More only pays with cores to spare: on one core,
+//BenchmarkPeerPool runs ~8% slower with 4 than with 1
+var peerConns = 1
+
+//hands calls to a peer's connections in turn
+type peerPool struct {
+	conns []caller
+	next  uint32
+}
+
+func (p *peerPool) Call(method string, args interface{}, reply interface{}) error {
+	i := atomic.AddUint32(&p.next, 1)
+	return p.conns[int(i%uint32(len(p.conns)))].Call(method, args, reply)
+}
+
+func (p *peerPool) Close() error {
+	closePeers(p.conns)
+	return nil
+}
+
+//n connections made with dial, used as one
+func dialPool(n int, dial func() (caller, error)) (caller, error) {
+	if n <= 1 {
+		return dial()
+	}
+	pool := &peerPool{}
+	for i := 0; i < n; i++ {
+		c, err := dial()
+		if err != nil {
+			closePeers(pool.conns)
+			return nil, err
+		}
+		pool.conns = append(pool.conns, c)
+	}
+	return pool, nil
+}
+
+//call this server's own methods over an in-memory pipe instead of a tcp
+//connection to its own port
+var inProcessSelf = false
+
+//an rpc client for this server itself that never touches the network; it
+//still goes through the codec, so handlers get their own copy of the
+//arguments just as from any other peer
+func (s *Server) dialSelf() caller {
+	return s.dialPipe("self")
+}
+
+//an rpc client for this server over an in-memory pipe, with source as the
+//caller the rate limits see
+func (s *Server) dialPipe(source string) caller {
+	sc, cc := net.Pipe()
+	rpcServer := rpc.NewServer()
+	rpcServer.RegisterName("Server", &connServer{Server: s, source: source})
+	if rpcCodec == "binary" {
+		s.serve(sc, func() {
+			rpcServer.ServeCodec(newBinaryCodec(sc))
+		})
+		return rpc.NewClientWithCodec(newBinaryCodec(cc))
+	}
+	s.serve(sc, func() {
+		rpcServer.ServeConn(sc)
+	})
+	return rpc.NewClient(cc)
+}
+
+//how often a failed call to a peer is retried, and the first wait between tries
+var peerRetries = 5
+var peerBackoff = 100 * time.Millisecond
+
+//how many peers the final broadcast of a round may lose before giving up
+var peerFailures = 0
+
+//rounds a degraded peer is skipped for before it's tried again, so one
+//blip doesn't cut off its clients for good [0 for never]
+var degradedRounds = 10
+
+//peers that stayed down through a broadcast, with the rounds left until
+//they're tried again
+type degradedPeers struct {
+	lock  *sync.Mutex
+	peers map[int]int
+}
+
+func newDegradedPeers() *degradedPeers {
+	return &degradedPeers{
+		lock:  new(sync.Mutex),
+		peers: make(map[int]int),
+	}
+}
+
+func (d *degradedPeers) mark(i int) {
+	d.lock.Lock()
+	d.peers[i] = degradedRounds
+	d.lock.Unlock()
+}
+
+func (d *degradedPeers) is(i int) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	_, ok := d.peers[i]
+	return ok
+}
+
+//a call to i went through after all
+func (d *degradedPeers) clear(i int) {
+	d.lock.Lock()
+	delete(d.peers, i)
+	d.lock.Unlock()
+}
+
+//a round finished; peers whose time is up are tried again
+func (d *degradedPeers) tick() {
+	if degradedRounds == 0 {
+		return
+	}
+	d.lock.Lock()
+	for i := range d.peers {
+		d.peers[i]--
+		if d.peers[i] <= 0 {
+			log.Printf("trying degraded server %d again", i)
+			delete(d.peers, i)
+		}
+	}
+	d.lock.Unlock()
+}
+
+//calls method on server i, and on failure retries over a fresh connection
+//with exponential backoff, since the cached one may be dead
+func (s *Server) callPeer(i int, method string, args interface{}, reply interface{}) error {
+	err := s.rpcServers[i].Call(method, args, reply)
+	wait := peerBackoff
+	for try := 0; err != nil && try < peerRetries; try++ {
+		select {
+		case <-time.After(wait):
+		case <-s.ctx.Done():
+			return s.ctx.Err()
+		}
+		wait *= 2
+		var rpcServer caller
+		rpcServer, err = dialPeer(s.servers[i])
+		if err != nil {
+			continue
+		}
+		err = rpcServer.Call(method, args, reply)
+		if c, ok := rpcServer.(io.Closer); ok {
+			c.Close()
+		}
+	}
+	if err == nil && s.degraded.is(i) {
+		s.degraded.clear(i)
+	}
+	return err
+}
+
+//passes a round's shuffle on to the next server, retrying through
+//callPeer; if the next server stays down, the round is given up on here
+//instead of taking the whole server down with it.
+//There is no skipping ahead to the server after it: every block still
+//carries the dead server's secretbox layer and every key is still
+//encrypted to the aggregate key including its share, so nobody further
+//down could open them. Routing around a server takes clients resealing
+//for, and a key shuffle over, the servers that are left.
+//Nor does it wrap from the last server to the first, ring topology or not:
+//the last hop peels the last layer clients sealed, so there's no hop left
+//for server 0 to run. What goes around a ring is the finished output, to
+//ringCoordinator through publish, never another hop of the shuffle.
+func (s *Server) handoff(round uint64, method string, args interface{}) error {
+	err := s.callPeer(s.id+1, method, args, nil)
+	if err != nil {
+		log.Printf("round %d: aborted, couldn't hand off to server %d: %v", round, s.id+1, err)
+		s.AbortRound(round, nil)
+	}
+	return err
+}
+
+//calls method on every healthy server; peers that stay down are marked
+//degraded and skipped from then on, up to peerFailures of them
+func (s *Server) broadcast(method string, args interface{}) error {
+	return s.fanOut(method, 0, func(i int) error {
+		return s.callPeer(i, method, args, nil)
+	})
+}
+
+//runs call for every healthy server, at most limit at a time (0 for no
+//limit), marking the ones that fail as degraded
+func (s *Server) fanOut(method string, limit int, call func(i int) error) error {
+	if limit <= 0 {
+		limit = len(s.rpcServers)
+	}
+	sem := make(chan bool, limit)
+	errs := make([]error, len(s.rpcServers))
+	var wg sync.WaitGroup
+	for i := range s.rpcServers {
+		if s.degraded.is(i) {
+			continue
+		}
+		wg.Add(1)
+		sem <- true
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = call(i)
+			<-sem
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			log.Printf("%s to server %d failed, marking it degraded: %v", method, i, err)
+			s.degraded.mark(i)
+		}
+	}
+	failed := 0
+	for i := range s.servers {
+		if s.degraded.is(i) {
+			failed++
+		}
+	}
+	if failed > peerFailures {
+		return fmt.Errorf("%d servers down, can tolerate %d", failed, peerFailures)
+	}
+	return nil
+}
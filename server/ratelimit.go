@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/rpc"
+	"sync"
+	"time"
+
+	. "github.com/kwonalbert/riffle/lib" //types and utils
+)
+
+//token bucket per source, refilled at rate tokens/sec up to burst
+type rateLimiter struct {
+	lock    *sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+	swept   time.Time //last time full buckets were dropped
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		lock:    new(sync.Mutex),
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+//rate <= 0 means unlimited
+func (rl *rateLimiter) allow(source string) bool {
+	if rl == nil || rl.rate <= 0 {
+		return true
+	}
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	now := time.Now()
+	rl.sweep(now)
+	b, ok := rl.buckets[source]
+	if !ok {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[source] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+//drops the buckets that have refilled to burst, which is what a source
+//without one starts at anyway, so one-off sources don't pile up. Goes at
+//most once per the time an empty bucket takes to refill; rl.lock has to be
+//held
+func (rl *rateLimiter) sweep(now time.Time) {
+	refill := time.Duration(rl.burst / rl.rate * float64(time.Second))
+	if now.Sub(rl.swept) < refill {
+		return
+	}
+	rl.swept = now
+	for source, b := range rl.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, source)
+		}
+	}
+}
+
+//the rpc methods as seen from one connection, so handlers can tell callers apart
+type connServer struct {
+	*Server
+	source string
+}
+
+func (c *connServer) Register(serverId int, reply *RegisterReply) error {
+	if !c.regLimiter.allow(c.source) {
+		return ErrRateLimited
+	}
+	return c.Server.Register(serverId, reply)
+}
+
+func (c *connServer) RegisterPriority(args *RegisterArgs, reply *RegisterReply) error {
+	if !c.regLimiter.allow(c.source) {
+		return ErrRateLimited
+	}
+	return c.Server.RegisterPriority(args, reply)
+}
+
+func (c *connServer) TryRegister(serverId int, reply *RegisterReply) error {
+	if !c.regLimiter.allow(c.source) {
+		return ErrRateLimited
+	}
+	return c.Server.TryRegister(serverId, reply)
+}
+
+//the addresses the server list resolves to, looked up once rather than on
+//every call from a client. Hosts that don't resolve then are never taken
+//for peers
+type peerAddrs struct {
+	once *sync.Once
+	ips  []net.IP
+}
+
+func newPeerAddrs() *peerAddrs {
+	return &peerAddrs{once: new(sync.Once)}
+}
+
+//resolves the server list, once; connectServers does it up front, before
+//any peer has reason to call
+func (s *Server) resolvePeers() []net.IP {
+	s.peerAddrs.once.Do(func() {
+		for _, addr := range s.servers {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				continue
+			}
+			ips, err := net.LookupHost(host)
+			if err != nil {
+				log.Printf("server %d: couldn't resolve server %s: %v", s.id, addr, err)
+				continue
+			}
+			for _, ip := range ips {
+				s.peerAddrs.ips = append(s.peerAddrs.ips, net.ParseIP(ip))
+			}
+		}
+	})
+	return s.peerAddrs.ips
+}
+
+//whether the other end is a server of the cluster: this one or a peer over
+//a pipe, or a host from the server list. Servers sharing a host with
+//clients can't be told apart from them this way
+func (c *connServer) fromPeer() bool {
+	switch c.source {
+	case "self", "cluster":
+		return true
+	case "client":
+		return false
+	}
+	source := net.ParseIP(c.source)
+	if source == nil {
+		return false
+	}
+	for _, ip := range c.resolvePeers() {
+		if source.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//aborting a round takes it away from every client, so only servers may
+func (c *connServer) AbortRound(round uint64, reply *int) error {
+	if !c.fromPeer() {
+		return ErrNotPeer
+	}
+	return c.Server.AbortRound(round, reply)
+}
+
+//the client map decides where blocks are accepted, so only servers
+//may send it
+func (c *connServer) PutClientMap(clientMap *ClientMap, reply *int) error {
+	if !c.fromPeer() {
+		return ErrNotPeer
+	}
+	return c.Server.PutClientMap(clientMap, reply)
+}
+
+//collected requests and blocks are broadcast to every server as the
+//shuffle's output, so only servers may hand them in
+func (c *connServer) CollectRequests(rs *[]Request, reply *int) error {
+	if !c.fromPeer() {
+		return ErrNotPeer
+	}
+	return c.Server.CollectRequests(rs, reply)
+}
+
+func (c *connServer) CollectBlocks(batch *BlockBatch, reply *int) error {
+	if !c.fromPeer() {
+		return ErrNotPeer
+	}
+	return c.Server.CollectBlocks(batch, reply)
+}
+
+//starting a round moves the whole cluster along, so only servers may
+func (c *connServer) StartRound(start *RoundStart, reply *int) error {
+	if !c.fromPeer() {
+		return ErrNotPeer
+	}
+	return c.Server.StartRound(start, reply)
+}
+
+//a key shuffle proof chunk is checked as one of a peer's, so only servers
+//may send them
+func (c *connServer) PutAuxChunk(chunk *AuxKeyChunk, reply *int) error {
+	if !c.fromPeer() {
+		return ErrNotPeer
+	}
+	return c.Server.PutAuxChunk(chunk, reply)
+}
+
+//how often an idle accepted connection is probed, so one whose other end
+//died without closing it is dropped within a few periods instead of hours
+//[0 for the OS default]
+var tcpKeepAlive = 30 * time.Second
+
+//like rpc.Server.Accept, but remembers who is on the other end of each connection
+func (s *Server) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			//Stop closing the listener is the only way it should end
+			if s.ctx.Err() == nil {
+				s.fail(fmt.Errorf("accepting connections: %v", err))
+			}
+			return
+		}
+		if tc, ok := conn.(*net.TCPConn); ok && tcpKeepAlive > 0 {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(tcpKeepAlive)
+		}
+		host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+		if err != nil {
+			host = conn.RemoteAddr().String()
+		}
+		rpcServer := rpc.NewServer()
+		rpcServer.RegisterName("Server", &connServer{Server: s, source: host})
+		s.serve(conn, func() {
+			serveCodec(rpcServer, conn)
+		})
+	}
+}
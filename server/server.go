@@ -2,18 +2,24 @@
 package main
 
 import (
-	"crypto/cipher"
+	"bufio"
+	"context"
+	crand "crypto/rand"
 	"encoding/binary"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"math"
 	"net"
-	"net/rpc"
 	"os"
 	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"sync"
+	"sync/atomic"
 
 	"time"
 
@@ -22,7 +28,6 @@ import (
 	"github.com/dedis/crypto/abstract"
 	"github.com/dedis/crypto/edwards"
 	"github.com/dedis/crypto/proof"
-	"github.com/dedis/crypto/shuffle"
 
 	"golang.org/x/crypto/nacl/secretbox"
 	"golang.org/x/crypto/sha3"
@@ -32,16 +37,127 @@ var TotalClients = 0
 var profile = false
 var debug = false
 
+//perf trace of the shuffle phases, as csv rows
+var timingWriter io.Writer = ioutil.Discard
+var timingLock = new(sync.Mutex)
+
+//buffer the perf trace, flushing it at the end of every round and on Stop,
+//and whether to also sync the file then, so a crash of the whole machine
+//doesn't lose finished rounds either
+var timingBuffered = false
+var timingSync = false
+var timingFile *os.File
+
+//log a round, with its phase breakdown, if it or any one phase took longer
+//than this [0 for never]
+var slowRoundThreshold time.Duration = 0
+
+//fraction of clients a round settles for once roundDeadline passes; past
+//it, a missing client registered with priority p is waited on for up to
+//p*priorityGrace more
+//(0 deadline means wait for everyone); missing slots become dummies
+var quorum = 1.0
+var roundDeadline time.Duration = 0
+var priorityGrace time.Duration = 0
+
+//collect requests for exactly this long before shuffling them, padding
+//whoever is missing, so when the shuffle starts doesn't tell who was fast
+//[0 to shuffle as soon as the requests are in]
+var requestWindow time.Duration = 0
+
+//marks a request this server padded the window with, until it's shuffled
+const paddedId = -1
+
+//the one server that takes registrations and hands the whole client map
+//to the others once they're done, instead of every registration being
+//broadcast as it happens [-1 for the broadcast]
+var regCoordinator = -1
+
+//how long a round's slot is held, after its blocks are ready, for this
+//server's clients to download them before the slot can take a new round
+//[0 to not wait]
+var downloadLatch time.Duration = 0
+
+//rounds past the next unfinished one a client may already send requests
+//or uploads for [0 for no limit]
+var maxRoundsAhead uint64 = 0
+
+//gzip block batches handed between servers; only pays off once blocks are
+//plaintext (PutPlainBlocks) and compressible
+var compressBlocks = false
+
+//where all keys, secrets and permutations are drawn from (e.g. an HSM)
+var randSource io.Reader = crand.Reader
+
+//how long registration can stall before it's reported, and whether to then
+//go ahead with the clients that did register
+var registerTimeout time.Duration = 0
+var allowPartial = false
+
+//how long every server gets to set up for the registered clients before
+//registration gives up [0 for no limit]
+var setupWait time.Duration = 0
+
+//first client id handed out, so clusters with disjoint ranges can be merged;
+//internally clients are still indexed from 0
+var clientIdBase = 0
+
+//registrations per second (0 for unlimited) and burst, per source address
+var registerRate = 0.0
+var registerBurst = 1
+
+//whether this server takes clients or, listed in -shuffleonly, only shuffles
+func (s *Server) isEntry() bool {
+	return TakesClients(s.id)
+}
+
+//how long GetResponse waits for the other servers' contributions
+//[0 for forever]
+var responseTimeout time.Duration = 0
+
+//fill every missing client's slot with random bytes the size of a real
+//upload, so a round's volume doesn't give away how many clients took part
+var dummyTraffic = false
+
+//what each server's permutation is drawn with, picked by name with -perm;
+//new generators are added to permGens
+var permGen PermutationGenerator = UniformPermutation{}
+var permGens = map[string]PermutationGenerator{
+	"uniform": UniformPermutation{},
+}
+
+//log every phase a round enters, as "round N: phase"
+var logPhases = false
+
+//rounds a server runs before it stops on its own [0 for no limit]; a
+//round counts as done once its responses are ready, so the last round's
+//downloads only finish first with -dllatch
+var maxTotalRounds uint64 = 0
+
 //any variable/func with 2: similar object as s-c but only s-s
 type Server struct {
+	ctx        context.Context //cancelling it stops all background work
+	cancel     context.CancelFunc
+	parent     context.Context //what ctx was made from, for Reset
+	draining   int32           //set by Drain, read atomically
 	port1      int
 	id         int
 	servers    []string //other servers
-	rpcServers []*rpc.Client
-	regLock    []*sync.Mutex //registration mutex
+	rpcServers []caller
+	peerAddrs  *peerAddrs      //what servers resolves to, for fromPeer
+	listener   net.Listener    //nil until Start
+	tasks      *sync.WaitGroup //goroutines Reset waits out, serving conns among them
+	connsLock  *sync.Mutex
+	conns      map[net.Conn]bool
+	regLock    []*sync.Mutex   //registration mutex
+	regPending *sync.WaitGroup //TryRegister notifications still going out
+	regLimiter *rateLimiter
 	regChan    chan bool
 	regDone    chan bool
+	regReady   chan bool //closed once registration is done
 	running    chan bool
+	ready      chan bool //closed once rounds run, after RegisterDone2's setup
+	finished   chan bool //closed once maxTotalRounds rounds are done
 	secretLock *sync.Mutex
 
 	FSMode bool //true for microblogging, false for file sharing
@@ -55,32 +171,90 @@ type Server struct {
 	pks        []abstract.Point //all servers pks
 	nextPks    []abstract.Point
 	nextPksBin [][]byte
+	pksDigest  []byte    //hash of pks, which every server's nextPks are summed from
+	pksRdy     chan bool //closed once pksDigest is set
+	connected  chan bool //closed once connectServers is done
 	ephSecret  abstract.Scalar
+	randSource io.Reader
 
 	//used during key shuffle
-	pi             []int
-	keys           [][]byte
-	keysRdy        chan bool
-	auxProofChan   []chan AuxKeyProof
-	keyUploadChan  chan UpKey
-	keyShuffleChan chan InternalKey //collect all uploads together
+	pi        []int
+	piSalt    []byte
+	piCommit  []byte      //published commitment to pi, for auditing
+	setupKeys *keyShuffle //keys shuffled once at setup, unless RoundKeys
 
 	//clients
 	clientMap    map[int]int //maps clients to dedicated server
+	priorities   map[int]int //clients registered with a nonzero priority
 	numClients   int         //#clients connect here
 	totalClients int         //total number of clients (sum of all servers)
 	maskss       [][][]byte  //clients' masks for PIR
 	secretss     [][][]byte  //shared secret used to xor
+	chainLock    *sync.Mutex
+	chainRound   [][]uint64   //1 + the round each client's chains last advanced on, per slot
+	departed     map[int]bool //clients whose chains were wiped by Deregister
+	chainErrors  uint64
+	proofsOK     uint64 //key shuffle proofs verified
+	proofsBad    uint64 //and failed
 
 	//all rounds
-	rounds []*Round
+	rounds  []*Round
+	store   blockStore //all blocks stored on this server, per round
+	archive *archive   //completed rounds' blocks, with -archive
+
+	summaries *summaryFeed //with -summarysock
+
+	degraded *degradedPeers //servers that dropped out, whose clients can't be served
+	barrier  *barrier       //servers that reached each round, with -barrier
+	mem      *memGuard      //rounds admitted under -memlimit
+	aborts   *roundAborts   //rounds given up on cluster-wide
+	failure  *failure       //what stopped the server, if anything did
+
+	respLatency *latencyHistogram //GetResponse latency, every client
+
+	//round progress, for introspection
+	progressLock *sync.Mutex
+	phases       map[uint64]int //phase of each round in flight
+	started      map[uint64]time.Time
+	timings      map[uint64][]phaseTiming //with slowRoundThreshold or summaries
+	completed    uint64
+	highest      uint64
 
 	memProf *os.File
 }
 
+//phases of a round, in the order they happen
+const (
+	phaseRequests = iota
+	phaseShuffleRequests
+	phaseUploads
+	phaseShuffleUploads
+	phaseResponses
+)
+
+var phaseNames = []string{"requests", "shuffle_requests", "uploads", "shuffle_uploads", "responses"}
+
 //per round variables
 type Round struct {
-	allBlocks []Block //all blocks store on this server
+	setupOnce *sync.Once
+
+	//full round number each phase of this slot is currently gathering for,
+	//since round and round+MaxRounds share the slot
+	activeLock *sync.Mutex
+	activeCond *sync.Cond
+	reqActive  uint64
+	upActive   uint64
+	reqsDone   uint64 //1 + the last round whose request hashes were published
+	upsDone    uint64 //1 + the last round whose upload hashes were published
+	keyActive  uint64
+	aborted    uint64   //1 + the last round aborted, to wake await
+	halted     bool     //the server is being torn down, nobody waits anymore
+	uploaded   []uint64 //1 + the round each client's block was last taken for
+	subRound   uint64   //1 + the round subs and pads count for
+	subs       int      //blocks this server couldn't open and replaced or dropped
+	pads       int      //requests this server padded in when -reqwindow closed
+
+	keyShuffle *keyShuffle //this slot's keys, with RoundKeys
 
 	//requesting
 	reqChan2     []chan Request
@@ -91,12 +265,12 @@ type Round struct {
 	//uploading
 	ublockChan2 []chan Block
 	shuffleChan chan []Block
-	upHashesRdy []chan bool
 
 	//downloading
 	upHashes    [][]byte
 	dblocksChan chan []Block
 	blocksRdy   []chan bool
+	downloads   chan uint64 //round of each download done, for awaitDownloads
 	xorsChan    []map[int](chan Block)
 }
 
@@ -105,8 +279,20 @@ type Round struct {
 //////////////////////////////
 
 func NewServer(port1 int, id int, servers []string, FSMode bool) *Server {
+	return NewServerContext(context.Background(), port1, id, servers, FSMode)
+}
+
+func NewServerContext(ctx context.Context, port1 int, id int, servers []string, FSMode bool) *Server {
+	if id < 0 || id >= len(servers) {
+		log.Fatalf("server id %d out of range (have %d servers)", id, len(servers))
+	}
+	if err := CheckSizes(); err != nil {
+		log.Fatal(err)
+	}
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
 	suite := edwards.NewAES128SHA256Ed25519(false)
-	rand := suite.Cipher(abstract.RandomKey)
+	rand := suite.Cipher(readSeed(randSource))
 	sk := suite.Scalar().Pick(rand)
 	pk := suite.Point().Mul(nil, sk)
 	pkBin := MarshalPoint(pk)
@@ -115,8 +301,17 @@ func NewServer(port1 int, id int, servers []string, FSMode bool) *Server {
 	rounds := make([]*Round, MaxRounds)
 
 	for i := range rounds {
+		activeLock := new(sync.Mutex)
 		r := Round{
-			allBlocks: nil,
+			setupOnce: new(sync.Once),
+
+			activeLock: activeLock,
+			activeCond: sync.NewCond(activeLock),
+			reqActive:  uint64(i),
+			upActive:   uint64(i),
+			reqsDone:   uint64(i),
+			upsDone:    uint64(i),
+			keyActive:  uint64(i),
 
 			reqChan2:     nil,
 			requestsChan: nil,
@@ -125,10 +320,9 @@ func NewServer(port1 int, id int, servers []string, FSMode bool) *Server {
 
 			ublockChan2: nil,
 			shuffleChan: make(chan []Block), //collect all uploads together
-			upHashesRdy: nil,
 
 			upHashes:    nil,
-			dblocksChan: make(chan []Block),
+			dblocksChan: make(chan []Block, 1), //so PutPlainBlocks doesn't wait on handleResponses
 			blocksRdy:   nil,
 			xorsChan:    make([]map[int](chan Block), len(servers)),
 		}
@@ -136,14 +330,28 @@ func NewServer(port1 int, id int, servers []string, FSMode bool) *Server {
 	}
 
 	s := Server{
+		ctx:        ctx,
+		cancel:     cancel,
+		parent:     parent,
 		port1:      port1,
 		id:         id,
 		servers:    servers,
+		peerAddrs:  newPeerAddrs(),
+		tasks:      new(sync.WaitGroup),
+		connsLock:  new(sync.Mutex),
+		conns:      make(map[net.Conn]bool),
 		regLock:    []*sync.Mutex{new(sync.Mutex), new(sync.Mutex)},
+		regPending: new(sync.WaitGroup),
+		regLimiter: newRateLimiter(registerRate, registerBurst),
 		regChan:    make(chan bool, TotalClients),
 		regDone:    make(chan bool),
+		regReady:   make(chan bool),
 		running:    make(chan bool),
+		ready:      make(chan bool),
+		finished:   make(chan bool),
 		secretLock: new(sync.Mutex),
+		chainLock:  new(sync.Mutex),
+		departed:   make(map[int]bool),
 
 		suite:      suite,
 		g:          suite,
@@ -153,32 +361,42 @@ func NewServer(port1 int, id int, servers []string, FSMode bool) *Server {
 		pks:        make([]abstract.Point, len(servers)),
 		nextPks:    make([]abstract.Point, len(servers)),
 		nextPksBin: make([][]byte, len(servers)),
+		pksRdy:     make(chan bool),
+		connected:  make(chan bool),
 		ephSecret:  ephSecret,
+		randSource: randSource,
 
-		pi:             nil,
-		keys:           nil,
-		keysRdy:        nil,
-		auxProofChan:   make([]chan AuxKeyProof, len(servers)),
-		keyUploadChan:  nil,
-		keyShuffleChan: make(chan InternalKey),
+		pi:        nil,
+		setupKeys: nil,
 
 		clientMap:    make(map[int]int),
+		priorities:   make(map[int]int),
 		numClients:   0,
 		totalClients: 0,
 		maskss:       nil,
 		secretss:     nil,
 
 		rounds: rounds,
+		store:  newMemStore(),
+
+		degraded: newDegradedPeers(),
+		barrier:  newBarrier(),
+		mem:      newMemGuard(),
+		aborts:   newRoundAborts(),
+		failure:  newFailure(),
+
+		respLatency: newLatencyHistogram(),
+
+		progressLock: new(sync.Mutex),
+		phases:       make(map[uint64]int),
+		started:      make(map[uint64]time.Time),
+		timings:      make(map[uint64][]phaseTiming),
 
 		FSMode: FSMode,
 
 		memProf: nil,
 	}
 
-	for i := range s.auxProofChan {
-		s.auxProofChan[i] = make(chan AuxKeyProof, len(servers))
-	}
-
 	return &s
 }
 
@@ -186,50 +404,97 @@ func NewServer(port1 int, id int, servers []string, FSMode bool) *Server {
 //Helpers
 ////////////////////////////////
 
-func (s *Server) runHandlers() {
-	<-s.regDone
+func (s *Server) runHandlers() error {
+	select {
+	case <-s.regDone:
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
 
-	runHandler(s.gatherKeys, 1)
-	runHandler(s.shuffleKeys, 1)
+	s.runHandler(s.gatherKeys, keyRounds())
+	s.runHandler(s.shuffleKeys, keyRounds())
 
-	runHandler(s.gatherRequests, MaxRounds)
-	runHandler(s.shuffleRequests, MaxRounds)
-	runHandler(s.gatherUploads, MaxRounds)
-	runHandler(s.shuffleUploads, MaxRounds)
-	runHandler(s.handleResponses, MaxRounds)
+	s.runHandler(s.gatherRequests, MaxRounds)
+	s.runHandler(s.shuffleRequests, MaxRounds)
+	s.runHandler(s.gatherUploads, MaxRounds)
+	s.runHandler(s.shuffleUploads, MaxRounds)
+	s.runHandler(s.handleResponses, MaxRounds)
 
-	s.running <- true
+	select {
+	case s.running <- true:
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+	return nil
 }
 
 func (s *Server) gatherRequests(round uint64) {
 	rnd := round % MaxRounds
+	if s.FSMode {
+		s.setPhase(round, phaseRequests)
+		s.startRound(round)
+	}
+	s.round(rnd).activate(&s.round(rnd).reqActive, round)
 	allReqs := make([]Request, s.totalClients)
-	var wg sync.WaitGroup
-	for i := 0; i < s.totalClients; i++ {
-		wg.Add(1)
-		go func(i int) {
-			defer wg.Done()
-			req := <-s.rounds[rnd].reqChan2[i]
+	get := func(i int, stop chan bool) bool {
+		select {
+		case req := <-s.round(rnd).reqChan2[i]:
 			req.Id = 0
 			allReqs[i] = req
-		}(i)
+			return true
+		case <-stop:
+			return false
+		}
+	}
+	var got []bool
+	if requestWindow > 0 {
+		got = s.gatherWindow(round, requestWindow, get)
+	} else {
+		got = s.gather(round, get)
+	}
+	padded := 0
+	for i := range got {
+		if !got[i] {
+			if requestWindow > 0 {
+				allReqs[i] = Request{Hash: s.randomBlock(HashSize), Round: round, Id: paddedId}
+				padded++
+				continue
+			}
+			allReqs[i] = Request{Hash: s.dummyBlock(HashSize), Round: round, Id: 0}
+		}
+	}
+	if padded > 0 {
+		s.round(rnd).pad(round, padded)
 	}
-	wg.Wait()
 
-	s.rounds[rnd].requestsChan <- allReqs
+	select {
+	case s.round(rnd).requestsChan <- allReqs:
+	case <-s.aborted(round):
+	case <-s.ctx.Done():
+	}
 }
 
 func (s *Server) shuffleRequests(round uint64) {
 	rnd := round % MaxRounds
-	allReqs := <-s.rounds[rnd].requestsChan
+	var allReqs []Request
+	select {
+	case allReqs = <-s.round(rnd).requestsChan:
+	case <-s.aborted(round):
+		return
+	case <-s.ctx.Done():
+		return
+	}
+	s.setPhase(round, phaseShuffleRequests)
 
 	//construct permuted blocks
 	input := make([][]byte, s.totalClients)
+	padded := make([]bool, s.totalClients)
 	for i := range input {
 		input[i] = allReqs[s.pi[i]].Hash
+		padded[i] = allReqs[s.pi[i]].Id == paddedId
 	}
 
-	s.shuffle(input, round)
+	s.shuffle(input, padded, round)
 
 	reqs := make([]Request, s.totalClients)
 	for i := range reqs {
@@ -238,64 +503,81 @@ func (s *Server) shuffleRequests(round uint64) {
 
 	t := time.Now()
 	if s.id == len(s.servers)-1 {
-		var wg sync.WaitGroup
-		for _, rpcServer := range s.rpcServers {
-			wg.Add(1)
-			go func(rpcServer *rpc.Client) {
-				defer wg.Done()
-				err := rpcServer.Call("Server.PutPlainRequests", &reqs, nil)
-				if err != nil {
-					log.Fatal("Failed uploading shuffled and decoded reqs: ", err)
-				}
-			}(rpcServer)
+		err := s.publish("Server.PutPlainRequests", "Server.CollectRequests", &reqs)
+		if err != nil {
+			log.Fatalf("round %d: failed uploading shuffled and decoded reqs: %v", round, err)
 		}
-		wg.Wait()
 	} else {
-		err := s.rpcServers[s.id+1].Call("Server.ShareServerRequests", &reqs, nil)
+		err := s.handoff(round, "Server.ShareServerRequests", &reqs)
 		if err != nil {
-			log.Fatal("Couldn't hand off the requests to next server", s.id+1, err)
+			return
 		}
 	}
 
-	if profile {
-		fmt.Println("round", round, ". ", s.id, "server shuffle req: ", time.Since(t))
-	}
+	s.logTiming(round, "shuffle_req", time.Since(t))
 }
 
 func (s *Server) handleResponses(round uint64) {
 	rnd := round % MaxRounds
-	allBlocks := <-s.rounds[rnd].dblocksChan
+	var allBlocks []Block
+	for allBlocks == nil {
+		select {
+		case allBlocks = <-s.round(rnd).dblocksChan:
+			//left over from an aborted round
+			if allBlocks[0].Round != round {
+				allBlocks = nil
+			}
+		case <-s.aborted(round):
+			s.finishRound(round)
+			return
+		case <-s.ctx.Done():
+			return
+		}
+	}
+	s.setPhase(round, phaseResponses)
+	defer s.finishRound(round)
 	//store it on this server as well
-	s.rounds[rnd].allBlocks = allBlocks
+	err := s.store.put(rnd, allBlocks)
+	if err != nil {
+		log.Fatalf("round %d: couldn't store blocks: %v", round, err)
+	}
+	if s.archive != nil {
+		err = s.archive.put(round, allBlocks)
+		if err != nil {
+			log.Printf("round %d: couldn't archive blocks: %v", round, err)
+		}
+	}
 
 	if s.FSMode {
 		t := time.Now()
 
 		for i := range allBlocks {
-			s.rounds[rnd].upHashes[i] = allBlocks[i].Block[BlockSize:]
+			s.round(rnd).upHashes[i] = allBlocks[i].Block[BlockSize:]
 		}
 
-		for i := range s.rounds[rnd].upHashesRdy {
-			if s.clientMap[i] != s.id {
-				continue
-			}
-			go func(i int) {
-				s.rounds[rnd].upHashesRdy[i] <- true
-			}(i)
-		}
+		s.round(rnd).activate(&s.round(rnd).upsDone, round+1)
 
+		xorLimit := newLimiter(XorWorkers)
 		var wg sync.WaitGroup
 		for i := 0; i < s.totalClients; i++ {
-			if s.clientMap[i] == s.id {
+			if s.clientMap[i] == s.id || s.degraded.is(s.clientMap[i]) {
 				continue
 			}
 			//if it doesnt belong to me, xor things and send it over
 			wg.Add(1)
-			go func(i int, rpcServer *rpc.Client, r uint64) {
+			go func(i int, rpcServer caller, r uint64) {
 				defer wg.Done()
+				xorLimit.acquire()
 				res := ComputeResponse(allBlocks, s.maskss[r][i], s.secretss[r][i])
-				sha3.ShakeSum256(s.secretss[r][i], s.secretss[r][i])
-				sha3.ShakeSum256(s.maskss[r][i], s.maskss[r][i])
+				xorLimit.release()
+				s.advanceChains(round, i, true)
+				for _, c := range s.xorChildren(i) {
+					b, ok := s.contribution(round, c, i, nil)
+					if !ok {
+						return
+					}
+					Xor(b, res)
+				}
 				//fmt.Println(s.id, round, "mask", i, s.maskss[i])
 				cb := ClientBlock{
 					CId: i,
@@ -307,48 +589,126 @@ func (s *Server) handleResponses(round uint64) {
 				}
 				err := rpcServer.Call("Server.PutClientBlock", cb, nil)
 				if err != nil {
-					log.Fatal("Couldn't put block: ", err)
+					log.Fatalf("round %d: couldn't put block: %v", round, err)
 				}
-			}(i, s.rpcServers[s.clientMap[i]], rnd)
+				//encoded and sent by the time Call returns
+				PutBlock(res)
+			}(i, s.rpcServers[s.xorParent(i)], rnd)
 		}
 		wg.Wait()
 
-		if profile {
-			fmt.Println(s.id, "handling_resp:", time.Since(t))
-		}
+		s.logTiming(round, "handle_resp", time.Since(t))
 	}
 
-	for i := range s.rounds[rnd].blocksRdy {
+	mine := 0
+	for i := range s.round(rnd).blocksRdy {
 		if s.clientMap[i] != s.id {
 			continue
 		}
+		mine++
 		go func(i int, round uint64) {
-			s.rounds[rnd].blocksRdy[i] <- true
+			s.round(rnd).blocksRdy[i] <- true
 		}(i, round)
 	}
+	s.awaitDownloads(round, mine)
+}
+
+//holds the round's slot until n downloads of round are done, or for at
+//most downloadLatch
+func (s *Server) awaitDownloads(round uint64, n int) {
+	if downloadLatch == 0 {
+		return
+	}
+	deadline := time.After(downloadLatch)
+	for n > 0 {
+		select {
+		case r := <-s.round(round % MaxRounds).downloads:
+			if r == round {
+				n--
+			}
+		case <-deadline:
+			log.Printf("round %d: %d downloads still outstanding, moving on", round, n)
+			return
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+//tells awaitDownloads a download of round is done; never blocks, a late
+//one for a round nobody waits on anymore is just ignored
+func (r *Round) downloaded(round uint64) {
+	select {
+	case r.downloads <- round:
+	default:
+	}
 }
 
 func (s *Server) gatherUploads(round uint64) {
 	rnd := round % MaxRounds
+	if !s.FSMode {
+		s.setPhase(round, phaseUploads)
+		s.startRound(round)
+	} else {
+		//clients pick what to upload from the published request hashes,
+		//so the round's uploads only open once those are out
+		s.round(rnd).await(&s.round(rnd).reqsDone, round+1)
+		if s.aborts.is(round) {
+			return
+		}
+	}
+	s.round(rnd).activate(&s.round(rnd).upActive, round)
 	allBlocks := make([]Block, s.totalClients)
-	var wg sync.WaitGroup
-	for i := 0; i < s.totalClients; i++ {
-		wg.Add(1)
-		go func(i int) {
-			defer wg.Done()
-			block := <-s.rounds[rnd].ublockChan2[i]
-			block.Id = 0
-			allBlocks[i] = block
-		}(i)
+	got := s.gather(round, func(i int, stop chan bool) bool {
+		for {
+			select {
+			case block := <-s.round(rnd).ublockChan2[i]:
+				//client id and full round tie the block to this gather
+				if block.Id != i || block.Round != round {
+					log.Printf("round %d: discarding block from client %d for round %d in slot %d",
+						round, block.Id+clientIdBase, block.Round, i)
+					continue
+				}
+				block.Id = 0
+				allBlocks[i] = block
+				return true
+			case <-stop:
+				return false
+			}
+		}
+	})
+	for i := range got {
+		if !got[i] {
+			allBlocks[i] = Block{Block: s.dummyBlock(BlockSize), Round: round, Id: 0}
+		}
 	}
-	wg.Wait()
 
-	s.rounds[rnd].shuffleChan <- allBlocks
+	select {
+	case s.round(rnd).shuffleChan <- allBlocks:
+	case <-s.aborted(round):
+	case <-s.ctx.Done():
+	}
 }
 
 func (s *Server) shuffleUploads(round uint64) {
 	rnd := round % MaxRounds
-	allBlocks := <-s.rounds[rnd].shuffleChan
+	var allBlocks []Block
+	select {
+	case allBlocks = <-s.round(rnd).shuffleChan:
+	case <-s.aborted(round):
+		return
+	case <-s.ctx.Done():
+		return
+	}
+	s.setPhase(round, phaseShuffleUploads)
+
+	//uploads have to be shuffled the same way the requests were. both are
+	//opened with the keys the key shuffle left in pi's order, and only this
+	//server knows pi, so the next server's keys line up with its input only
+	//if pi is what put it in order. shuffling uploads with a pi of their own
+	//takes a second set of client keys and a second key shuffle under it.
+	//s.pi is set once in setupClients and never changes after, so both
+	//phases of every round get the same one
 
 	//construct permuted blocks
 	input := make([][]byte, s.totalClients)
@@ -356,7 +716,10 @@ func (s *Server) shuffleUploads(round uint64) {
 		input[i] = allBlocks[s.pi[i]].Block
 	}
 
-	s.shuffle(input, round)
+	s.shuffle(input, nil, round)
+	if s.id == len(s.servers)-1 {
+		padDummies(input)
+	}
 
 	uploads := make([]Block, s.totalClients)
 	for i := range uploads {
@@ -365,41 +728,41 @@ func (s *Server) shuffleUploads(round uint64) {
 
 	t := time.Now()
 
+	batch, err := PackBlocks(uploads, compressBlocks)
+	if err != nil {
+		log.Fatalf("round %d: couldn't pack blocks: %v", round, err)
+	}
+
 	if s.id == len(s.servers)-1 {
-		var wg sync.WaitGroup
-		for _, rpcServer := range s.rpcServers {
-			wg.Add(1)
-			go func(rpcServer *rpc.Client) {
-				defer wg.Done()
-				err := rpcServer.Call("Server.PutPlainBlocks", &uploads, nil)
-				if err != nil {
-					log.Fatal("Failed uploading shuffled and decoded blocks: ", err)
-				}
-			}(rpcServer)
+		err := s.publish("Server.PutPlainBlocks", "Server.CollectBlocks", batch)
+		if err != nil {
+			log.Fatalf("round %d: failed uploading shuffled and decoded blocks: %v", round, err)
 		}
-		wg.Wait()
 	} else {
-		err := s.rpcServers[s.id+1].Call("Server.ShareServerBlocks", &uploads, nil)
+		err := s.handoff(round, "Server.ShareServerBlocks", batch)
 		if err != nil {
-			log.Fatal("Couldn't hand off the blocks to next server", s.id+1, err)
+			return
 		}
 	}
-	if profile {
-		fmt.Println("round", round, ". ", s.id, "server shuffle: ", time.Since(t))
-	}
+	s.logTiming(round, "shuffle_up", time.Since(t))
 }
 
-func (s *Server) gatherKeys(_ uint64) {
-	allKeys := make([]UpKey, s.totalClients)
-	for i := 0; i < s.totalClients; i++ {
-		key := <-s.keyUploadChan
-		allKeys[key.Id] = key
+func (s *Server) gatherKeys(round uint64) {
+	ks := s.keyShuffle(round)
+	if RoundKeys {
+		rnd := round % MaxRounds
+		s.round(rnd).activate(&s.round(rnd).keyActive, round)
+	}
+	allKeys, ok := s.gatherKeyUploads(ks, round)
+	if !ok {
+		return
 	}
 
-	serversLeft := len(s.servers) - s.id
+	//KeyChunks rows per server, each shuffled on its own
+	rows := (len(s.servers) - s.id) * KeyChunks
 
-	Xss := make([][][]byte, serversLeft)
-	Yss := make([][][]byte, serversLeft)
+	Xss := make([][][]byte, rows)
+	Yss := make([][][]byte, rows)
 
 	for i := range Xss {
 		Xss[i] = make([][]byte, s.totalClients)
@@ -411,96 +774,118 @@ func (s *Server) gatherKeys(_ uint64) {
 	}
 
 	ik := InternalKey{
-		Xss: append([][][]byte{nil}, Xss...),
-		Yss: append([][][]byte{nil}, Yss...),
-		SId: s.id,
+		Xss:   append(make([][][]byte, KeyChunks), Xss...),
+		Yss:   append(make([][][]byte, KeyChunks), Yss...),
+		SId:   s.id,
+		Round: round,
 	}
 
 	aux := AuxKeyProof{
 		OrigXss: Xss,
 		OrigYss: Yss,
 		SId:     s.id,
+		Round:   round,
 	}
 
-	var wg sync.WaitGroup
-	for _, rpcServer := range s.rpcServers {
-		wg.Add(1)
-		go func(rpcServer *rpc.Client) {
-			defer wg.Done()
-			err := rpcServer.Call("Server.PutAuxProof", &aux, nil)
-			if err != nil {
-				log.Fatal("Failed uploading shuffled and decoded blocks: ", err)
-			}
-		}(rpcServer)
+	err := s.sendAuxProof(aux)
+	if err != nil {
+		log.Fatalf("round %d: failed sending aux proof: %v", round, err)
 	}
-	wg.Wait()
 
-	s.keyShuffleChan <- ik
+	select {
+	case ks.keyShuffleChan <- ik:
+	case <-s.ctx.Done():
+	}
 }
 
-func (s *Server) shuffleKeys(_ uint64) {
-	keys := <-s.keyShuffleChan
+func (s *Server) shuffleKeys(round uint64) {
+	ks := s.keyShuffle(round)
+	var keys InternalKey
+	select {
+	case keys = <-ks.keyShuffleChan:
+	case <-s.ctx.Done():
+		return
+	}
 
-	serversLeft := len(s.servers) - s.id
+	//row i is chunk i%KeyChunks of the keys for server s.id+i/KeyChunks;
+	//every row gets its own shuffle and proof, all with the same pi
+	rows := (len(s.servers) - s.id) * KeyChunks
 
-	Xss := make([][]abstract.Point, serversLeft)
-	Yss := make([][]abstract.Point, serversLeft)
+	Xss := make([][]abstract.Point, rows)
+	Yss := make([][]abstract.Point, rows)
 	for i := range Xss {
 		Xss[i] = make([]abstract.Point, s.totalClients)
 		Yss[i] = make([]abstract.Point, s.totalClients)
 		for j := range Xss[i] {
-			Xss[i][j] = UnmarshalPoint(s.suite, keys.Xss[i+1][j])
-			Yss[i][j] = UnmarshalPoint(s.suite, keys.Yss[i+1][j])
+			Xss[i][j] = UnmarshalPoint(s.suite, keys.Xss[i+KeyChunks][j])
+			Yss[i][j] = UnmarshalPoint(s.suite, keys.Yss[i+KeyChunks][j])
 		}
 	}
 
-	Xbarss := make([][]abstract.Point, serversLeft)
-	Ybarss := make([][]abstract.Point, serversLeft)
-	decss := make([][]abstract.Point, serversLeft)
-	prfs := make([][]byte, serversLeft)
+	Xbarss := make([][]abstract.Point, rows)
+	Ybarss := make([][]abstract.Point, rows)
+	decss := make([][]abstract.Point, rows)
+	prfs := make([][]byte, rows)
 
+	shuffleLimit := newLimiter(shuffleWorkers)
 	var shuffleWG sync.WaitGroup
-	for i := 0; i < serversLeft; i++ {
+	for i := 0; i < rows; i++ {
 		shuffleWG.Add(1)
 		go func(i int, pk abstract.Point) {
 			defer shuffleWG.Done()
-			//only one chunk
-			rand := s.suite.Cipher(abstract.RandomKey)
+			shuffleLimit.acquire()
+			rand := s.newRand()
 			var prover proof.Prover
 			var err error
 			Xbarss[i], Ybarss[i], prover = Shuffle(s.pi, s.g, nil, pk, Xss[i], Yss[i], rand)
 			prfs[i], err = proof.HashProve(s.suite, "PairShuffle", rand, prover)
 			if err != nil {
-				log.Fatal("Shuffle proof failed: " + err.Error())
+				log.Fatalf("round %d: shuffle proof failed: %v", round, err)
 			}
+			shuffleLimit.release()
+			decLimit := newLimiter(decryptWorkers)
 			var decWG sync.WaitGroup
 			decss[i] = make([]abstract.Point, s.totalClients)
 			for j := range decss[i] {
 				decWG.Add(1)
 				go func(i int, j int) {
 					defer decWG.Done()
+					decLimit.acquire()
 					decss[i][j] = Decrypt(s.g, Xbarss[i][j], Ybarss[i][j], s.sk)
+					decLimit.release()
 				}(i, j)
 			}
 			decWG.Wait()
 
-		}(i, s.nextPks[i])
+		}(i, s.nextPks[i/KeyChunks])
 	}
 	shuffleWG.Wait()
 
-	//whatever is at index 0 belongs to me
-	for i := range decss[0] {
-		s.keys[i] = MarshalPoint(decss[0][i])
+	//whatever is in the first KeyChunks rows belongs to me; a client can
+	//still have encrypted a useless point, which past the shuffle can only be
+	//told by its slot, so it gets a key nobody knows and its blocks won't open
+	for j := 0; j < s.totalClients; j++ {
+		chunks := make([][]byte, KeyChunks)
+		for k := range chunks {
+			err := CheckPoint(s.g, decss[k][j])
+			if err != nil {
+				log.Printf("round %d: bad key in shuffled slot %d, using a dummy: %v", round, j, err)
+				decss[k][j], _ = s.g.Point().Pick(nil, s.newRand())
+			}
+			chunks[k] = MarshalPoint(decss[k][j])
+		}
+		ks.keys[j] = KeyFromChunks(chunks)
 	}
 
 	ik := InternalKey{
-		Xss: make([][][]byte, serversLeft),
-		Yss: make([][][]byte, serversLeft),
-		SId: s.id,
+		Xss:   make([][][]byte, rows),
+		Yss:   make([][][]byte, rows),
+		SId:   s.id,
+		Round: keys.Round,
 
-		Ybarss: make([][][]byte, serversLeft),
+		Ybarss: make([][][]byte, rows),
 		Proofs: prfs,
-		Keys:   make([][]byte, serversLeft),
+		Keys:   make([][]byte, rows),
 	}
 
 	for i := range ik.Xss {
@@ -509,25 +894,25 @@ func (s *Server) shuffleKeys(_ uint64) {
 		ik.Ybarss[i] = make([][]byte, s.totalClients)
 		for j := range ik.Xss[i] {
 			ik.Xss[i][j] = MarshalPoint(Xbarss[i][j])
-			if i == 0 {
-				//i == 0 is my point, so don't pass it to next person
+			if i < KeyChunks {
+				//the first rows are my points, so don't pass them to next person
 				ik.Yss[i][j] = MarshalPoint(s.g.Point().Base())
 			} else {
 				ik.Yss[i][j] = MarshalPoint(decss[i][j])
 			}
 			ik.Ybarss[i][j] = MarshalPoint(Ybarss[i][j])
 		}
-		ik.Keys[i] = s.nextPksBin[i]
+		ik.Keys[i] = s.nextPksBin[i/KeyChunks]
 	}
 
 	var wg sync.WaitGroup
 	for _, rpcServer := range s.rpcServers {
 		wg.Add(1)
-		go func(rpcServer *rpc.Client) {
+		go func(rpcServer caller) {
 			defer wg.Done()
 			err := rpcServer.Call("Server.ShareServerKeys", &ik, nil)
 			if err != nil {
-				log.Fatal("Failed uploading shuffled and decoded blocks: ", err)
+				log.Fatalf("round %d: failed uploading shuffled and decoded blocks: %v", round, err)
 			}
 		}(rpcServer)
 	}
@@ -539,114 +924,360 @@ func (s *Server) shuffleKeys(_ uint64) {
 ////////////////////////////////
 //register the client here, and notify the server it will be talking to
 //TODO: should check for duplicate clients, just in case..
-func (s *Server) Register(serverId int, clientId *int) error {
+func (s *Server) Register(serverId int, reply *RegisterReply) (err error) {
+	defer recoverRPC("Register", &err)
+	return s.register(RegisterArgs{ServerId: serverId}, reply)
+}
+
+//like Register, for a client whose slot late rounds should wait on longer
+func (s *Server) RegisterPriority(args *RegisterArgs, reply *RegisterReply) (err error) {
+	defer recoverRPC("RegisterPriority", &err)
+	if args.Priority < 0 {
+		return fmt.Errorf("Bad priority %d", args.Priority)
+	}
+	return s.register(*args, reply)
+}
+
+func (s *Server) register(args RegisterArgs, reply *RegisterReply) error {
+	if !s.isEntry() {
+		return ErrNotEntry
+	}
+	if s.isDraining() {
+		return ErrDraining
+	}
+	if args.ServerId < 0 || args.ServerId >= len(s.servers) {
+		return fmt.Errorf("Unknown server %d", args.ServerId)
+	}
+	if !TakesClients(args.ServerId) {
+		return fmt.Errorf("Server %d only shuffles, pick another", args.ServerId)
+	}
 	s.regLock[0].Lock()
-	*clientId = s.totalClients
+	client, err := s.assignId(args, reply)
+	if err != nil {
+		s.regLock[0].Unlock()
+		return err
+	}
+	s.notifyRegistration(client)
+	if s.totalClients == TotalClients {
+		err = s.registerDone()
+		if err != nil {
+			s.regLock[0].Unlock()
+			return err
+		}
+	}
+	fmt.Println("Registered", reply.Id)
+	s.regLock[0].Unlock()
+	return nil
+}
+
+//like Register, but never waits: it answers ErrNotAccepting if another
+//registration holds the lock, and tells the other servers in the background
+func (s *Server) TryRegister(serverId int, reply *RegisterReply) (err error) {
+	defer recoverRPC("TryRegister", &err)
+	if !s.isEntry() {
+		return ErrNotEntry
+	}
+	if s.isDraining() {
+		return ErrDraining
+	}
+	if serverId < 0 || serverId >= len(s.servers) {
+		return fmt.Errorf("Unknown server %d", serverId)
+	}
+	if !TakesClients(serverId) {
+		return fmt.Errorf("Server %d only shuffles, pick another", serverId)
+	}
+	if !s.regLock[0].TryLock() {
+		return ErrNotAccepting
+	}
+	client, err := s.assignId(RegisterArgs{ServerId: serverId}, reply)
+	if err != nil {
+		s.regLock[0].Unlock()
+		return err
+	}
+	s.regPending.Add(1)
+	go func() {
+		defer s.regPending.Done()
+		s.notifyRegistration(client)
+	}()
+	if s.totalClients < TotalClients {
+		fmt.Println("Registered", reply.Id)
+		s.regLock[0].Unlock()
+		return nil
+	}
+	//registerDone only returns once every server runs rounds, so finish in the
+	//background
+	go func() {
+		err := s.registerDone()
+		if err != nil {
+			log.Printf("server %d: couldn't finish registration: %v", s.id, err)
+		}
+		s.regLock[0].Unlock()
+	}()
+	fmt.Println("Registered", reply.Id)
+	return nil
+}
+
+//hands out the next client id; regLock[0] must be held
+func (s *Server) assignId(args RegisterArgs, reply *RegisterReply) (*ClientRegistration, error) {
+	if regCoordinator >= 0 && s.id != regCoordinator {
+		return nil, fmt.Errorf("Registration goes through server %d", regCoordinator)
+	}
+	if s.totalClients >= TotalClients || s.registered() {
+		return nil, ErrClusterFull
+	}
+	if s.totalClients == 0 && registerTimeout > 0 {
+		go s.watchRegistration()
+	}
+	*reply = RegisterReply{
+		Id:         clientIdBase + s.totalClients,
+		ServerId:   args.ServerId,
+		ServerAddr: s.servers[args.ServerId],
+	}
 	client := &ClientRegistration{
-		ServerId: serverId,
-		Id:       *clientId,
+		ServerId: args.ServerId,
+		Id:       s.totalClients,
+		Priority: args.Priority,
 	}
 	s.totalClients++
-	for _, rpcServer := range s.rpcServers {
+	return client, nil
+}
+
+func (s *Server) notifyRegistration(client *ClientRegistration) {
+	if regCoordinator >= 0 {
+		//the others get the whole map from registerDone
+		s.Register2(client, nil)
+		return
+	}
+	for i, rpcServer := range s.rpcServers {
 		err := rpcServer.Call("Server.Register2", client, nil)
 		if err != nil {
-			log.Fatal(fmt.Sprintf("Cannot connect to %d: ", serverId), err)
+			log.Fatal(fmt.Sprintf("Cannot connect to %d: ", i), err)
 		}
 	}
-	if s.totalClients == TotalClients {
-		s.registerDone()
+}
+
+func (s *Server) registered() bool {
+	select {
+	case <-s.regReady:
+		return true
+	default:
+		return false
+	}
+}
+
+//complains every registerTimeout until registration is done, instead of
+//hanging silently; with allowPartial, goes ahead with whoever registered
+func (s *Server) watchRegistration() {
+	start := time.Now()
+	for {
+		select {
+		case <-s.regReady:
+			return
+		case <-s.ctx.Done():
+			return
+		case <-time.After(registerTimeout):
+		}
+		s.regLock[0].Lock()
+		if !s.registered() {
+			log.Printf("server %d: registered %d/%d clients after %v",
+				s.id, s.totalClients, TotalClients, time.Since(start))
+			if allowPartial {
+				log.Printf("server %d: starting with %d clients", s.id, s.totalClients)
+				err := s.registerDone()
+				if err != nil {
+					log.Printf("server %d: couldn't finish registration: %v", s.id, err)
+				}
+			}
+		}
+		s.regLock[0].Unlock()
 	}
-	fmt.Println("Registered", *clientId)
-	s.regLock[0].Unlock()
-	return nil
 }
 
 //called to increment total number of clients
-func (s *Server) Register2(client *ClientRegistration, _ *int) error {
+func (s *Server) Register2(client *ClientRegistration, _ *int) (err error) {
+	defer recoverRPC("Register2", &err)
 	s.regLock[1].Lock()
 	s.clientMap[client.Id] = client.ServerId
+	if client.Priority != 0 {
+		s.priorities[client.Id] = client.Priority
+	}
 	s.regLock[1].Unlock()
 	return nil
 }
 
-func (s *Server) registerDone() {
-	for _, rpcServer := range s.rpcServers {
+//the coordinator's whole client map, in place of one Register2 per client
+func (s *Server) PutClientMap(clientMap *ClientMap, _ *int) (err error) {
+	defer recoverRPC("PutClientMap", &err)
+	for id, sid := range clientMap.Servers {
+		if sid < 0 || sid >= len(s.servers) {
+			return fmt.Errorf("Client %d mapped to unknown server %d", id, sid)
+		}
+	}
+	s.regLock[1].Lock()
+	s.clientMap = clientMap.Servers
+	s.priorities = clientMap.Priorities
+	if s.priorities == nil {
+		s.priorities = make(map[int]int)
+	}
+	s.regLock[1].Unlock()
+	return nil
+}
+
+func (s *Server) registerDone() error {
+	//everyone has to know where every client goes before rounds start
+	s.regPending.Wait()
+	if regCoordinator >= 0 {
+		s.regLock[1].Lock()
+		clientMap := ClientMap{
+			Servers:    make(map[int]int, len(s.clientMap)),
+			Priorities: make(map[int]int, len(s.priorities)),
+		}
+		for id, sid := range s.clientMap {
+			clientMap.Servers[id] = sid
+		}
+		for id, p := range s.priorities {
+			clientMap.Priorities[id] = p
+		}
+		s.regLock[1].Unlock()
+		for i, rpcServer := range s.rpcServers {
+			if i == s.id {
+				continue
+			}
+			err := rpcServer.Call("Server.PutClientMap", &clientMap, nil)
+			if err != nil {
+				return fmt.Errorf("Cannot send client map to %d: %v", i, err)
+			}
+		}
+	}
+	for i, rpcServer := range s.rpcServers {
 		err := rpcServer.Call("Server.RegisterDone2", s.totalClients, nil)
 		if err != nil {
-			log.Fatal("Cannot update num clients")
+			return fmt.Errorf("Cannot update num clients on %d: %v", i, err)
+		}
+	}
+	//the servers set up concurrently; clients only hear back once all are done
+	for i, rpcServer := range s.rpcServers {
+		err := rpcServer.Call("Server.GetReady", setupWait, nil)
+		if err != nil {
+			return fmt.Errorf("Server %d didn't get ready: %v", i, err)
 		}
 	}
 
 	for i := 0; i < s.totalClients; i++ {
 		s.regChan <- true
 	}
+	return nil
 }
 
-func (s *Server) RegisterDone2(numClients int, _ *int) error {
+func (s *Server) RegisterDone2(numClients int, _ *int) (err error) {
+	defer recoverRPC("RegisterDone2", &err)
+	//rounds over nobody have nothing to gather or shuffle
+	if numClients <= 0 {
+		return fmt.Errorf("Can't start rounds with %d clients", numClients)
+	}
 	s.totalClients = numClients
+	s.spawn(func() {
+		s.setupClients(numClients)
+	})
+	return nil
+}
 
-	size := (numClients/SecretSize)*SecretSize + SecretSize
+//RegisterDone2's allocations, which take a while with many clients
+func (s *Server) setupClients(numClients int) {
+	size := MaskSize(numClients)
 	s.maskss = make([][][]byte, MaxRounds)
 	s.secretss = make([][][]byte, MaxRounds)
+	s.chainRound = make([][]uint64, MaxRounds)
 	for r := range s.maskss {
 		s.maskss[r] = make([][]byte, numClients)
 		s.secretss[r] = make([][]byte, numClients)
+		s.chainRound[r] = make([]uint64, numClients)
 		for i := range s.maskss[r] {
 			s.maskss[r][i] = make([]byte, size)
 			s.secretss[r][i] = make([]byte, BlockSize)
 		}
 	}
 
-	s.pi = GeneratePI(numClients)
-
-	s.keys = make([][]byte, numClients)
-	s.keysRdy = make(chan bool, numClients)
-
-	s.keyUploadChan = make(chan UpKey, numClients)
-
-	for r := range s.rounds {
-		for i := 0; i < len(s.servers); i++ {
-			s.rounds[r].xorsChan[i] = make(map[int](chan Block))
-			for j := 0; j < numClients; j++ {
-				s.rounds[r].xorsChan[i][j] = make(chan Block)
-			}
-		}
-
-		s.rounds[r].requestsChan = make(chan []Request)
-		s.rounds[r].reqHashes = make([][]byte, numClients)
-
-		s.rounds[r].reqChan2 = make([]chan Request, numClients)
-		s.rounds[r].upHashes = make([][]byte, numClients)
-		s.rounds[r].blocksRdy = make([]chan bool, numClients)
-		s.rounds[r].upHashesRdy = make([]chan bool, numClients)
-		s.rounds[r].reqHashesRdy = make([]chan bool, numClients)
-		s.rounds[r].ublockChan2 = make([]chan Block, numClients)
-		for i := range s.rounds[r].blocksRdy {
-			s.rounds[r].reqChan2[i] = make(chan Request)
-			s.rounds[r].blocksRdy[i] = make(chan bool)
-			s.rounds[r].upHashesRdy[i] = make(chan bool)
-			s.rounds[r].reqHashesRdy[i] = make(chan bool)
-			s.rounds[r].ublockChan2[i] = make(chan Block)
-		}
+	pi, err := permGen.Permutation(numClients, s.randSource)
+	if err == nil {
+		err = CheckPI(pi, numClients)
+	}
+	if err != nil {
+		log.Fatal("Bad permutation from generator: ", err)
+	}
+	s.pi = pi
+	s.piSalt = readSeed(s.randSource)
+	s.piCommit = CommitPI(s.suite, s.piSalt, s.pi)
+
+	s.setupKeys = newKeyShuffle(numClients, len(s.servers))
+
+	//per round channels are allocated the first time each round slot is used
+	close(s.regReady)
+	select {
+	case s.regDone <- true:
+	case <-s.ctx.Done():
+		return
 	}
-	s.regDone <- true
 	fmt.Println(s.id, "Register done")
-	<-s.running
+	select {
+	case <-s.running:
+	case <-s.ctx.Done():
+		return
+	}
+	close(s.ready)
 	fmt.Println(s.id, "running")
-	return nil
 }
 
-func (s *Server) connectServers() {
-	rpcServers := make([]*rpc.Client, len(s.servers))
+//waits until this server's rounds run, or for at most wait [0 for no
+//limit]
+func (s *Server) GetReady(wait time.Duration, _ *int) (err error) {
+	defer recoverRPC("GetReady", &err)
+	var timeout <-chan time.Time
+	if wait > 0 {
+		timeout = time.After(wait)
+	}
+	select {
+	case <-s.ready:
+		return nil
+	case <-timeout:
+		return ErrNotReady
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+}
+
+func (s *Server) connectServers() (err error) {
+	s.resolvePeers()
+	rpcServers := make([]caller, len(s.servers))
+	defer func() {
+		if err != nil {
+			closePeers(rpcServers)
+		}
+	}()
 	for i := range rpcServers {
-		var rpcServer *rpc.Client
-		var err error = errors.New("")
+		dial := func() (caller, error) {
+			return dialPeer(s.servers[i])
+		}
+		if i == s.id && inProcessSelf {
+			dial = func() (caller, error) {
+				return s.dialSelf(), nil
+			}
+		} else if i == s.id { //make a local rpc
+			addr := fmt.Sprintf("127.0.0.1:%d", s.port1)
+			dial = func() (caller, error) {
+				return dialPeer(addr)
+			}
+		}
+		var rpcServer caller
+		err = errors.New("")
 		for err != nil {
-			if i == s.id { //make a local rpc
-				addr := fmt.Sprintf("127.0.0.1:%d", s.port1)
-				rpcServer, err = rpc.Dial("tcp", addr)
-			} else {
-				rpcServer, err = rpc.Dial("tcp", s.servers[i])
+			rpcServer, err = dialPool(peerConns, dial)
+			if err != nil {
+				select {
+				case <-time.After(100 * time.Millisecond):
+				case <-s.ctx.Done():
+					return s.ctx.Err()
+				}
 			}
 		}
 		rpcServers[i] = rpcServer
@@ -655,7 +1286,7 @@ func (s *Server) connectServers() {
 	var wg sync.WaitGroup
 	for i, rpcServer := range rpcServers {
 		wg.Add(1)
-		go func(i int, rpcServer *rpc.Client) {
+		go func(i int, rpcServer caller) {
 			defer wg.Done()
 			pk := make([]byte, SecretSize)
 			err := rpcServer.Call("Server.GetPK", 0, &pk)
@@ -674,349 +1305,1674 @@ func (s *Server) connectServers() {
 		s.nextPks[i] = pk
 		s.nextPksBin[i] = MarshalPoint(pk)
 	}
-	s.rpcServers = rpcServers
-}
 
-func (s *Server) GetNumClients(_ int, num *int) error {
-	<-s.regChan
-	*num = s.totalClients
-	return nil
-}
+	//everyone has to aggregate the same keys, or the key shuffle output can't be decrypted
+	h := s.suite.Hash()
+	for i := range s.pks {
+		h.Write(MarshalPoint(s.pks[i]))
+	}
+	s.pksDigest = h.Sum(nil)
+	close(s.pksRdy)
+	errs := make([]error, len(rpcServers))
+	for i, rpcServer := range rpcServers {
+		wg.Add(1)
+		go func(i int, rpcServer caller) {
+			defer wg.Done()
+			var digest []byte
+			errs[i] = rpcServer.Call("Server.GetPKsDigest", 0, &digest)
+			if errs[i] == nil && !SliceEquals(digest, s.pksDigest) {
+				errs[i] = fmt.Errorf("Server %d aggregates different server keys than server %d", i, s.id)
+			}
+			if errs[i] != nil {
+				return
+			}
+			//and hash blocks and size rounds the same way
+			var params Params
+			errs[i] = rpcServer.Call("Server.GetParams", 0, &params)
+			if errs[i] == nil {
+				errs[i] = LocalParams(s.suite, len(s.servers)).Check(params)
+			}
+		}(i, rpcServer)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
 
-func (s *Server) GetPK(_ int, pk *[]byte) error {
-	*pk = s.pkBin
+	s.rpcServers = rpcServers
+	close(s.connected)
 	return nil
 }
 
-func (s *Server) UploadKeys(key *UpKey, _ *int) error {
-	s.keyUploadChan <- *key
-	return nil
+//returns once this server is connected to every peer and has aggregated
+//their keys
+func (s *Server) WaitConnected(_ int, _ *int) (err error) {
+	defer recoverRPC("WaitConnected", &err)
+	select {
+	case <-s.connected:
+		return nil
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
 }
 
-func (s *Server) shareSecret(clientPublic abstract.Point) (abstract.Point, abstract.Point) {
-	s.secretLock.Lock()
-	rand := s.suite.Cipher(abstract.RandomKey)
-	gen := s.g.Point().Base()
-	secret := s.g.Scalar().Pick(rand)
+//waits for every server to be done with connectServers, so no round
+//calls a peer that can't take it yet
+func (s *Server) awaitPeersConnected() error {
+	errs := make([]error, len(s.rpcServers))
+	var wg sync.WaitGroup
+	for i, rpcServer := range s.rpcServers {
+		wg.Add(1)
+		go func(i int, rpcServer caller) {
+			defer wg.Done()
+			errs[i] = rpcServer.Call("Server.WaitConnected", 0, nil)
+		}(i, rpcServer)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("server %d didn't finish connecting: %v", i, err)
+		}
+	}
+	return nil
+}
+
+//hash of the server keys this server aggregated, to check everyone agrees
+func (s *Server) GetPKsDigest(_ int, digest *[]byte) (err error) {
+	defer recoverRPC("GetPKsDigest", &err)
+	select {
+	case <-s.pksRdy:
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
+	*digest = s.pksDigest
+	return nil
+}
+
+func (s *Server) GetNumClients(_ int, num *int) (err error) {
+	defer recoverRPC("GetNumClients", &err)
+	<-s.regChan
+	*num = s.totalClients
+	return nil
+}
+
+func (s *Server) GetParams(_ int, params *Params) (err error) {
+	defer recoverRPC("GetParams", &err)
+	*params = LocalParams(s.suite, len(s.servers))
+	return nil
+}
+
+//stop taking new clients and new rounds (RequestBlock starts a file sharing
+//round, UploadSmall a microblogging one), so the rounds already in flight can
+//finish before Stop
+func (s *Server) Drain() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+func (s *Server) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) == 1
+}
+
+//stops all the server's background work, and frees its port
+func (s *Server) Stop() {
+	s.cancel()
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	closePeers(s.rpcServers)
+	s.wipeClients()
+	flushTiming()
+	if s.summaries != nil {
+		s.summaries.Close()
+	}
+}
+
+//back to where NewServer left it, keys aside, so another scenario can run
+//on the same port once Start is called again: registration, secrets, the
+//permutation and all rounds are dropped. The listener and connections are
+//closed and every handler and call still running is woken and waited for
+//first, so nothing sees the state change under it; the other servers have
+//to be Reset too, as their connections here are gone
+func (s *Server) Reset() {
+	s.cancel()
+	s.aborts.abortAll()
+	for _, r := range s.rounds {
+		r.halt()
+	}
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	closePeers(s.rpcServers)
+	s.connsLock.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connsLock.Unlock()
+	s.tasks.Wait()
+
+	s.wipeClients()
+	fresh := NewServerContext(s.parent, s.port1, s.id, s.servers, s.FSMode)
+	fresh.sk, fresh.pk, fresh.pkBin = s.sk, s.pk, s.pkBin
+	fresh.ephSecret = s.ephSecret
+	fresh.store, fresh.archive = s.store, s.archive
+	fresh.summaries = s.summaries
+	fresh.memProf = s.memProf
+	*s = *fresh
+	vectorOnce = sync.Once{}
+}
+
+//runs f in its own goroutine, one Reset waits for
+func (s *Server) spawn(f func()) {
+	s.tasks.Add(1)
+	go func() {
+		defer s.tasks.Done()
+		f()
+	}()
+}
+
+//serves conn with serve until it's closed, by the other end or by Reset
+func (s *Server) serve(conn net.Conn, serve func()) {
+	s.connsLock.Lock()
+	s.conns[conn] = true
+	s.connsLock.Unlock()
+	s.spawn(func() {
+		serve()
+		s.connsLock.Lock()
+		delete(s.conns, conn)
+		s.connsLock.Unlock()
+	})
+}
+
+//listens on port1, connects to the other servers and, once registration is
+//done, runs the round handlers; if a step fails, whatever the earlier ones
+//set up is torn down so a retry can bind the port again
+func (s *Server) Start() (err error) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port1))
+	if err != nil {
+		return fmt.Errorf("Cannot start listening to the port: %v", err)
+	}
+	s.listener = l
+	s.spawn(func() {
+		s.accept(l)
+	})
+	return s.run()
+}
+
+//everything Start does past listening, for servers whose peers reach them
+//some other way
+func (s *Server) run() (err error) {
+	defer func() {
+		if err != nil {
+			s.Stop()
+		}
+	}()
+	err = s.connectServers()
+	if err != nil {
+		return fmt.Errorf("Couldn't connect to the other servers: %v", err)
+	}
+	err = s.awaitPeersConnected()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Starting server", s.id)
+	return s.runHandlers()
+}
+
+//like GetNumClients, but gives up after timeout with how far registration got
+func (s *Server) WaitForRegistration(timeout time.Duration, status *RegStatus) (err error) {
+	defer recoverRPC("WaitForRegistration", &err)
+	select {
+	case <-s.regReady:
+		status.Done = true
+	case <-time.After(timeout):
+		status.Done = false
+	}
+	s.regLock[1].Lock()
+	status.Registered = len(s.clientMap)
+	s.regLock[1].Unlock()
+	status.Expected = TotalClients
+	return nil
+}
+
+//commitment to this server's permutation, published for auditors
+func (s *Server) GetPICommitment(_ int, commit *[]byte) (err error) {
+	defer recoverRPC("GetPICommitment", &err)
+	if s.piCommit == nil {
+		return ErrNotReady
+	}
+	*commit = s.piCommit
+	return nil
+}
+
+//the permutation this server applies, to line shuffle inputs up with
+//outputs when debugging; it gives away which client sent what, so only
+//with -debug
+func (s *Server) ExportPermutation() ([]int, error) {
+	if !debug {
+		return nil, errors.New("Permutation is only exported with -debug")
+	}
+	if s.pi == nil {
+		return nil, ErrNotReady
+	}
+	pi := make([]int, len(s.pi))
+	copy(pi, s.pi)
+	return pi, nil
+}
+
+func (s *Server) ListRounds(_ int, status *RoundStatus) (err error) {
+	defer recoverRPC("ListRounds", &err)
+	s.progressLock.Lock()
+	defer s.progressLock.Unlock()
+	status.Completed = s.completed
+	status.Highest = s.highest
+	status.ChainErrors = atomic.LoadUint64(&s.chainErrors)
+	status.ProofsVerified = atomic.LoadUint64(&s.proofsOK)
+	status.ProofsFailed = atomic.LoadUint64(&s.proofsBad)
+	status.Phases = make(map[uint64]string)
+	for round, phase := range s.phases {
+		status.Phases[round] = phaseNames[phase]
+	}
+	return nil
+}
+
+//what a client needs to pick the least loaded entry server
+func (s *Server) GetServerLoad(_ int, load *LoadInfo) (err error) {
+	defer recoverRPC("GetServerLoad", &err)
+	s.regLock[1].Lock()
+	for _, sid := range s.clientMap {
+		if sid == s.id {
+			load.Clients++
+		}
+	}
+	s.regLock[1].Unlock()
+	s.progressLock.Lock()
+	load.Rounds = len(s.phases)
+	s.progressLock.Unlock()
+	load.Goroutines = runtime.NumGoroutine()
+	load.CPUs = runtime.NumCPU()
+	load.Heap = s.heapSize()
+	return nil
+}
+
+func (s *Server) GetPK(_ int, pk *[]byte) (err error) {
+	defer recoverRPC("GetPK", &err)
+	*pk = s.pkBin
+	return nil
+}
+
+func (s *Server) UploadKeys(key *UpKey, _ *int) (err error) {
+	defer recoverRPC("UploadKeys", &err)
+	if !s.isEntry() {
+		return ErrNotEntry
+	}
+	key.Id, err = s.clientIndex(key.Id)
+	if err != nil {
+		return err
+	}
+	rows := (len(s.servers) - s.id) * KeyChunks
+	if len(key.C1s) < rows || len(key.C2s) < rows {
+		return fmt.Errorf("Client %d uploaded too few keys", key.Id+clientIdBase)
+	}
+	for row := range key.C1s {
+		for _, c := range [][]byte{key.C1s[row], key.C2s[row]} {
+			_, err = UnmarshalValidPoint(s.suite, c)
+			if err != nil {
+				return fmt.Errorf("Bad key from client %d in row %d: %v", key.Id+clientIdBase, row, err)
+			}
+		}
+	}
+	if RoundKeys {
+		rnd := key.Round % MaxRounds
+		err = s.round(rnd).enter(&s.round(rnd).keyActive, key.Round)
+		if err != nil {
+			return err
+		}
+	}
+	s.keyShuffle(key.Round).keyUploadChan <- *key
+	return nil
+}
+
+func (s *Server) shareSecret(clientPublic abstract.Point) (abstract.Point, abstract.Point) {
+	s.secretLock.Lock()
+	rand := s.newRand()
+	gen := s.g.Point().Base()
+	secret := s.g.Scalar().Pick(rand)
 	public := s.g.Point().Mul(gen, secret)
 	sharedSecret := s.g.Point().Mul(clientPublic, secret)
 	s.secretLock.Unlock()
 	return public, sharedSecret
 }
 
-func (s *Server) ShareMask(clientDH *ClientDH, serverPub *[]byte) error {
-	pub, shared := s.shareSecret(UnmarshalPoint(s.suite, clientDH.Public))
-	mask := MarshalPoint(shared)
-	for r := 0; r < MaxRounds; r++ {
-		if r == 0 {
-			sha3.ShakeSum256(s.maskss[r][clientDH.Id], mask)
-		} else {
-			sha3.ShakeSum256(s.maskss[r][clientDH.Id], s.maskss[r-1][clientDH.Id])
-		}
+func (s *Server) ShareMask(clientDH *ClientDH, serverPub *[]byte) (err error) {
+	defer recoverRPC("ShareMask", &err)
+	clientDH.Id, err = s.clientIndex(clientDH.Id)
+	if err != nil {
+		return err
+	}
+	clientPub, err := UnmarshalValidPoint(s.suite, clientDH.Public)
+	if err != nil {
+		return fmt.Errorf("Bad DH point from client %d: %v", clientDH.Id+clientIdBase, err)
 	}
+	pub, shared := s.shareSecret(clientPub)
+	seedChain(s.maskss, clientDH.Id, MarshalPoint(shared), 0)
 	*serverPub = MarshalPoint(pub)
 	return nil
 }
 
-func (s *Server) ShareSecret(clientDH *ClientDH, serverPub *[]byte) error {
-	pub, shared := s.shareSecret(UnmarshalPoint(s.suite, clientDH.Public))
-	secret := MarshalPoint(shared)
-	for r := 0; r < MaxRounds; r++ {
-		if r == 0 {
-			sha3.ShakeSum256(s.secretss[r][clientDH.Id], secret)
-		} else {
-			sha3.ShakeSum256(s.secretss[r][clientDH.Id], s.secretss[r-1][clientDH.Id])
-		}
+func (s *Server) ShareSecret(clientDH *ClientDH, serverPub *[]byte) (err error) {
+	defer recoverRPC("ShareSecret", &err)
+	clientDH.Id, err = s.clientIndex(clientDH.Id)
+	if err != nil {
+		return err
 	}
+	clientPub, err := UnmarshalValidPoint(s.suite, clientDH.Public)
+	if err != nil {
+		return fmt.Errorf("Bad DH point from client %d: %v", clientDH.Id+clientIdBase, err)
+	}
+	pub, shared := s.shareSecret(clientPub)
+	seedChain(s.secretss, clientDH.Id, MarshalPoint(shared), 0)
 	//s.secretss[clientDH.Id] = make([]byte, len(MarshalPoint(shared)))
 	*serverPub = MarshalPoint(pub)
 	return nil
 }
 
-func (s *Server) GetEphKey(_ int, serverPub *[]byte) error {
-	pub := s.g.Point().Mul(s.g.Point().Base(), s.ephSecret)
-	*serverPub = MarshalPoint(pub)
+//starts client i's chains over from a fresh shared secret: round from
+//gets hash(seed), and each round after the hash of the one before
+func seedChain(chains [][][]byte, i int, seed []byte, from uint64) {
+	prev := seed
+	for k := uint64(0); k < MaxRounds; k++ {
+		rnd := (from + k) % MaxRounds
+		sha3.ShakeSum256(chains[rnd][i], prev)
+		prev = chains[rnd][i]
+	}
+}
+
+//redoes a registered client's ShareMask and ShareSecret, with its chains
+//restarting at rot.Round, so a client whose chains fell out of step can
+//pick up again without losing its slot; every server has to be rotated
+//before rot.Round and while the client has no round in flight
+func (s *Server) RotateClientKeys(rot *ClientRotation, reply *RotationReply) (err error) {
+	defer recoverRPC("RotateClientKeys", &err)
+	rot.Id, err = s.clientIndex(rot.Id)
+	if err != nil {
+		return err
+	}
+	if s.expired(rot.Round) {
+		return ErrRoundExpired
+	}
+	maskPub, err := UnmarshalValidPoint(s.suite, rot.Mask)
+	if err != nil {
+		return fmt.Errorf("Bad DH point from client %d: %v", rot.Id+clientIdBase, err)
+	}
+	secretPub, err := UnmarshalValidPoint(s.suite, rot.Secret)
+	if err != nil {
+		return fmt.Errorf("Bad DH point from client %d: %v", rot.Id+clientIdBase, err)
+	}
+	pub1, shared1 := s.shareSecret(maskPub)
+	pub2, shared2 := s.shareSecret(secretPub)
+
+	s.chainLock.Lock()
+	if s.departed[rot.Id] {
+		s.chainLock.Unlock()
+		return errDeparted(rot.Id)
+	}
+	seedChain(s.maskss, rot.Id, MarshalPoint(shared1), rot.Round)
+	seedChain(s.secretss, rot.Id, MarshalPoint(shared2), rot.Round)
+	//the new chains are where advanceChains expects them to be
+	for k := uint64(0); k < MaxRounds; k++ {
+		round := rot.Round + k
+		var last uint64 = 0
+		if round >= MaxRounds {
+			last = round + 1 - MaxRounds
+		}
+		s.chainRound[round%MaxRounds][rot.Id] = last
+	}
+	s.chainLock.Unlock()
+
+	reply.Mask = MarshalPoint(pub1)
+	reply.Secret = MarshalPoint(pub2)
 	return nil
 }
 
-func (s *Server) PutAuxProof(aux *AuxKeyProof, _ *int) error {
-	s.auxProofChan[aux.SId] <- *aux
+func (s *Server) GetEphKey(_ int, serverPub *[]byte) (err error) {
+	defer recoverRPC("GetEphKey", &err)
+	pub := s.g.Point().Mul(s.g.Point().Base(), s.ephSecret)
+	*serverPub = MarshalPoint(pub)
 	return nil
 }
 
-func (s *Server) ShareServerKeys(ik *InternalKey, correct *bool) error {
-	aux := <-s.auxProofChan[ik.SId]
+func (s *Server) ShareServerKeys(ik *InternalKey, correct *bool) (err error) {
+	defer recoverRPC("ShareServerKeys", &err)
+	if ik.SId < 0 || ik.SId >= len(s.servers) {
+		return fmt.Errorf("Key shuffle from unknown server %d", ik.SId)
+	}
+	err = s.checkInternalKey(ik)
+	if err != nil {
+		return err
+	}
+	ks := s.keyShuffle(ik.Round)
+	aux := <-ks.auxProofChan[ik.SId]
 	good := s.verifyShuffle(*ik, aux)
+	ks.transcriptLock.Lock()
+	ks.transcript.Hops[ik.SId] = TranscriptHop{Key: *ik, Aux: aux}
+	ks.transcriptLock.Unlock()
+	if good && ik.SId == len(s.servers)-1 && keyVectorFile != "" {
+		vectorOnce.Do(func() { s.dumpVector(ks) })
+	}
 
-	if ik.SId != len(s.servers)-1 {
+	hop := s.keyHop(ik.SId)
+	if hop.forwardAux {
 		aux = AuxKeyProof{
-			OrigXss: ik.Xss[1:],
-			OrigYss: ik.Yss[1:],
+			OrigXss: ik.Xss[KeyChunks:],
+			OrigYss: ik.Yss[KeyChunks:],
 			SId:     ik.SId + 1,
+			Round:   ik.Round,
 		}
-		s.auxProofChan[aux.SId] <- aux
+		ks.auxProofChan[aux.SId] <- aux
 	}
-
-	if ik.SId == len(s.servers)-1 && s.id == 0 {
+	if hop.myInput {
+		ik.Ybarss = nil
+		ik.Proofs = nil
+		ik.Keys = nil
+		ks.keyShuffleChan <- *ik
+	}
+	if hop.notifyClients {
 		for i := 0; i < s.totalClients; i++ {
 			go func() {
-				s.keysRdy <- true
+				ks.keysRdy <- true
 			}()
 		}
-	} else if ik.SId == s.id-1 {
-		ik.Ybarss = nil
-		ik.Proofs = nil
-		ik.Keys = nil
-		s.keyShuffleChan <- *ik
 	}
 	*correct = good
 	return nil
 }
 
-func (s *Server) KeyReady(id int, _ *int) error {
-	<-s.keysRdy
+//what this server does with the output of key shuffle hop sid
+type keyHopAction struct {
+	forwardAux    bool //output is the input the next hop's proof is checked against
+	myInput       bool //output is what this server shuffles next
+	notifyClients bool //shuffle is finished and this server's clients are waiting
+}
+
+//the key shuffle runs server 0, 1, ..., n-1, each hop broadcast to everyone:
+//  - every hop but the last one feeds the next hop's aux proof
+//  - hop s.id-1 feeds this server's shuffle; server 0 has no such hop and
+//    takes its input from gatherKeys instead
+//  - the last hop ends the shuffle; clients upload keys to and wait on server 0
+func (s *Server) keyHop(sid int) keyHopAction {
+	last := len(s.servers) - 1
+	return keyHopAction{
+		forwardAux:    sid < last,
+		myInput:       s.id > 0 && sid == s.id-1,
+		notifyClients: sid == last && s.id == 0,
+	}
+}
+
+//where the first complete key shuffle is written as a test vector
+//[empty for nowhere]
+var keyVectorFile = ""
+var vectorOnce sync.Once
+
+func (s *Server) dumpVector(ks *keyShuffle) {
+	ks.transcriptLock.Lock()
+	v := NewShuffleVector(s.suite, ks.transcript)
+	ks.transcriptLock.Unlock()
+	f, err := os.Create(keyVectorFile)
+	if err != nil {
+		log.Println("Couldn't write key shuffle vector: ", err)
+		return
+	}
+	defer f.Close()
+	err = WriteShuffleVector(f, v)
+	if err != nil {
+		log.Println("Couldn't write key shuffle vector: ", err)
+	}
+}
+
+//checks a vector written with -keyvector against this build
+func verifyVectorFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	v, err := ReadShuffleVector(f)
+	if err != nil {
+		return err
+	}
+	return VerifyShuffleVector(edwards.NewAES128SHA256Ed25519(false), v)
+}
+
+//the key shuffle for round as this server saw it, to verify offline with
+//VerifyTranscript; without RoundKeys, every round has the setup shuffle's
+func (s *Server) GetTranscript(round uint64, t *Transcript) (err error) {
+	defer recoverRPC("GetTranscript", &err)
+	if !s.registered() {
+		return ErrNotReady
+	}
+	ks := s.keyShuffle(round)
+	ks.transcriptLock.Lock()
+	defer ks.transcriptLock.Unlock()
+	for _, hop := range ks.transcript.Hops {
+		if hop.Key.Proofs == nil || (RoundKeys && hop.Key.Round != round) {
+			return ErrNotReady
+		}
+	}
+	*t = ks.transcript
+	return nil
+}
+
+func (s *Server) KeyReady(arg *RequestArg, _ *int) (err error) {
+	defer recoverRPC("KeyReady", &err)
+	<-s.keyShuffle(arg.Round).keysRdy
 	return nil
 }
 
 /////////////////////////////////
 //Request
 ////////////////////////////////
-func (s *Server) RequestBlock(req *Request, hashes *[][]byte) error {
+func (s *Server) RequestBlock(req *Request, hashes *[][]byte) (err error) {
+	defer recoverRPC("RequestBlock", &err)
+	if !s.isEntry() {
+		return ErrNotEntry
+	}
+	if s.isDraining() {
+		return ErrDraining
+	}
+	req.Id, err = s.clientIndex(req.Id)
+	if err != nil {
+		return err
+	}
+	err = s.checkMapped(req.Id)
+	if err != nil {
+		return err
+	}
+	if s.expired(req.Round) {
+		return ErrRoundExpired
+	}
+	err = s.admitRound(req.Round)
+	if err != nil {
+		return err
+	}
 	round := req.Round % MaxRounds
-	err := s.rpcServers[0].Call("Server.RequestBlock2", req, nil)
-	<-s.rounds[round].reqHashesRdy[req.Id]
-	*hashes = s.rounds[round].reqHashes
-	return err
+	traceLog(req.Trace, req.Round, "request from client %d at server %d", req.Id+clientIdBase, s.id)
+	err = s.rpcServers[0].Call("Server.RequestBlock2", req, nil)
+	if err != nil {
+		//rejected, e.g. too far ahead; no hashes are coming for it
+		traceLog(req.Trace, req.Round, "request rejected: %v", err)
+		return err
+	}
+	select {
+	case <-s.round(round).reqHashesRdy[req.Id]:
+	case <-s.aborted(req.Round):
+		traceLog(req.Trace, req.Round, "request aborted")
+		return ErrRoundAborted
+	}
+	traceLog(req.Trace, req.Round, "request hashes ready at server %d", s.id)
+	*hashes = s.round(round).reqHashes
+	return nil
 }
 
-func (s *Server) RequestBlock2(req *Request, _ *int) error {
+func (s *Server) RequestBlock2(req *Request, _ *int) (err error) {
+	defer recoverRPC("RequestBlock2", &err)
+	err = s.checkSlot(req.Id)
+	if err != nil {
+		return err
+	}
+	err = s.checkAhead(req.Round)
+	if err != nil {
+		return err
+	}
 	round := req.Round % MaxRounds
-	s.rounds[round].reqChan2[req.Id] <- *req
+	err = s.round(round).enter(&s.round(round).reqActive, req.Round)
+	if err != nil {
+		return err
+	}
+	traceLog(req.Trace, req.Round, "request reached server %d", s.id)
+	select {
+	case s.round(round).reqChan2[req.Id] <- *req:
+	case <-s.aborted(req.Round):
+		return ErrRoundAborted
+	}
 	return nil
 }
 
-func (s *Server) PutPlainRequests(rs *[]Request, _ *int) error {
+func (s *Server) PutPlainRequests(rs *[]Request, _ *int) (err error) {
+	defer recoverRPC("PutPlainRequests", &err)
 	reqs := *rs
+	err = s.checkBatch(len(reqs))
+	if err != nil {
+		return err
+	}
 	round := reqs[0].Round % MaxRounds
 	for i := range reqs {
-		s.rounds[round].reqHashes[i] = reqs[i].Hash
+		s.round(round).reqHashes[i] = reqs[i].Hash
 	}
+	s.round(round).activate(&s.round(round).reqsDone, reqs[0].Round+1)
 
-	for i := range s.rounds[round].reqHashesRdy {
+	for i := range s.round(round).reqHashesRdy {
 		if s.clientMap[i] != s.id {
 			continue
 		}
 		go func(i int, round uint64) {
-			s.rounds[round].reqHashesRdy[i] <- true
+			s.round(round).reqHashesRdy[i] <- true
 		}(i, round)
 	}
 
 	return nil
 }
 
-func (s *Server) ShareServerRequests(reqs *[]Request, _ *int) error {
+func (s *Server) ShareServerRequests(reqs *[]Request, _ *int) (err error) {
+	defer recoverRPC("ShareServerRequests", &err)
+	err = s.checkBatch(len(*reqs))
+	if err != nil {
+		return err
+	}
 	round := (*reqs)[0].Round % MaxRounds
-	s.rounds[round].requestsChan <- *reqs
+	select {
+	case s.round(round).requestsChan <- *reqs:
+	case <-s.aborted((*reqs)[0].Round):
+		return ErrRoundAborted
+	}
 	return nil
 }
 
 /////////////////////////////////
 //Upload
 ////////////////////////////////
-func (s *Server) UploadBlock(block *Block, hashes *[][]byte) error {
+func (s *Server) UploadBlock(block *Block, hashes *[][]byte) (err error) {
+	defer recoverRPC("UploadBlock", &err)
+	if !s.isEntry() {
+		return ErrNotEntry
+	}
+	block.Id, err = s.clientIndex(block.Id)
+	if err != nil {
+		return err
+	}
+	err = s.checkMapped(block.Id)
+	if err != nil {
+		return err
+	}
+	if s.expired(block.Round) {
+		return ErrRoundExpired
+	}
+	err = s.checkBlockSize(block)
+	if err != nil {
+		return err
+	}
 	round := block.Round % MaxRounds
-	err := s.rpcServers[0].Call("Server.UploadBlock2", block, nil)
+	traceLog(block.Trace, block.Round, "upload from client %d at server %d", block.Id+clientIdBase, s.id)
+	err = s.rpcServers[0].Call("Server.UploadBlock2", block, nil)
 	if err != nil {
-		log.Fatal("Couldn't send block to first server: ", err)
+		//the first server turned it away; that's the client's problem
+		traceLog(block.Trace, block.Round, "upload rejected: %v", err)
+		return err
 	}
-	<-s.rounds[round].upHashesRdy[block.Id]
-	*hashes = s.rounds[round].upHashes
+	s.round(round).await(&s.round(round).upsDone, block.Round+1)
+	if s.aborts.is(block.Round) {
+		traceLog(block.Trace, block.Round, "upload aborted")
+		return ErrRoundAborted
+	}
+	traceLog(block.Trace, block.Round, "upload hashes ready at server %d", s.id)
+	*hashes = s.round(round).upHashes
 	return nil
 }
 
-func (s *Server) UploadBlock2(block *Block, _ *int) error {
+func (s *Server) UploadBlock2(block *Block, _ *int) (err error) {
+	defer recoverRPC("UploadBlock2", &err)
+	err = s.checkSlot(block.Id)
+	if err != nil {
+		return err
+	}
+	err = s.checkAhead(block.Round)
+	if err != nil {
+		return err
+	}
 	round := block.Round % MaxRounds
-	s.rounds[round].ublockChan2[block.Id] <- *block
+	err = s.round(round).enter(&s.round(round).upActive, block.Round)
+	if err != nil {
+		return err
+	}
+	s.setPhase(block.Round, phaseUploads)
+	if !s.round(round).firstUpload(block.Id, block.Round) {
+		traceLog(block.Trace, block.Round, "repeat upload dropped at server %d", s.id)
+		return nil
+	}
+	traceLog(block.Trace, block.Round, "upload reached server %d", s.id)
+	select {
+	case s.round(round).ublockChan2[block.Id] <- *block:
+	case <-s.aborted(block.Round):
+		return ErrRoundAborted
+	}
 	return nil
 }
 
-func (s *Server) UploadSmall(block *Block, _ *int) error {
-	err := s.rpcServers[0].Call("Server.UploadBlock2", block, nil)
+func (s *Server) UploadSmall(block *Block, _ *int) (err error) {
+	defer recoverRPC("UploadSmall", &err)
+	if !s.isEntry() {
+		return ErrNotEntry
+	}
+	if s.isDraining() {
+		return ErrDraining
+	}
+	block.Id, err = s.clientIndex(block.Id)
+	if err != nil {
+		return err
+	}
+	if s.expired(block.Round) {
+		return ErrRoundExpired
+	}
+	err = s.admitRound(block.Round)
 	if err != nil {
-		log.Fatal("Couldn't send block to first server: ", err)
+		return err
+	}
+	err = s.checkBlockSize(block)
+	if err != nil {
+		return err
+	}
+	traceLog(block.Trace, block.Round, "upload from client %d at server %d", block.Id+clientIdBase, s.id)
+	err = s.rpcServers[0].Call("Server.UploadBlock2", block, nil)
+	if err != nil {
+		traceLog(block.Trace, block.Round, "upload rejected: %v", err)
+		return err
 	}
 	return nil
 }
 
-func (s *Server) UploadSmall2(block *Block, _ *int) error {
+func (s *Server) UploadSmall2(block *Block, _ *int) (err error) {
+	defer recoverRPC("UploadSmall2", &err)
+	err = s.checkSlot(block.Id)
+	if err != nil {
+		return err
+	}
+	err = s.checkAhead(block.Round)
+	if err != nil {
+		return err
+	}
 	round := block.Round % MaxRounds
-	s.rounds[round].ublockChan2[block.Id] <- *block
+	err = s.round(round).enter(&s.round(round).upActive, block.Round)
+	if err != nil {
+		return err
+	}
+	if !s.round(round).firstUpload(block.Id, block.Round) {
+		return nil
+	}
+	select {
+	case s.round(round).ublockChan2[block.Id] <- *block:
+	case <-s.aborted(block.Round):
+		return ErrRoundAborted
+	}
 	return nil
 }
 
-func (s *Server) PutPlainBlocks(bs *[]Block, _ *int) error {
-	blocks := *bs
+func (s *Server) PutPlainBlocks(batch *BlockBatch, _ *int) (err error) {
+	defer recoverRPC("PutPlainBlocks", &err)
+	blocks, err := batch.Unpack()
+	if err != nil {
+		return err
+	}
+	err = s.checkBatch(len(blocks))
+	if err != nil {
+		return err
+	}
 	round := blocks[0].Round % MaxRounds
-
-	s.rounds[round].dblocksChan <- blocks
-
+	select {
+	case s.round(round).dblocksChan <- blocks:
+	case <-s.aborted(blocks[0].Round):
+		return ErrRoundAborted
+	}
 	return nil
 }
 
-func (s *Server) ShareServerBlocks(blocks *[]Block, _ *int) error {
-	round := (*blocks)[0].Round % MaxRounds
-	s.rounds[round].shuffleChan <- *blocks
+func (s *Server) ShareServerBlocks(batch *BlockBatch, _ *int) (err error) {
+	defer recoverRPC("ShareServerBlocks", &err)
+	blocks, err := batch.Unpack()
+	if err != nil {
+		return err
+	}
+	err = s.checkBatch(len(blocks))
+	if err != nil {
+		return err
+	}
+	round := blocks[0].Round % MaxRounds
+	select {
+	case s.round(round).shuffleChan <- blocks:
+	case <-s.aborted(blocks[0].Round):
+		return ErrRoundAborted
+	}
 	return nil
 }
 
 /////////////////////////////////
 //Download
 ////////////////////////////////
-func (s *Server) GetResponse(cmask ClientMask, response *[]byte) error {
+func (s *Server) GetResponse(cmask ClientMask, response *[]byte) (err error) {
+	defer recoverRPC("GetResponse", &err)
+	res, err := s.response(cmask)
+	if err != nil {
+		return err
+	}
+	*response = res.Block
+	return nil
+}
+
+//like GetResponse, with what the client needs to judge the block by
+func (s *Server) GetRoundResult(cmask ClientMask, res *RoundResult) (err error) {
+	defer recoverRPC("GetRoundResult", &err)
+	*res, err = s.response(cmask)
+	return err
+}
+
+func (s *Server) response(cmask ClientMask) (res RoundResult, err error) {
+	if !s.isEntry() {
+		return res, ErrNotEntry
+	}
+	cmask.Id, err = s.clientIndex(cmask.Id)
+	if err != nil {
+		return res, err
+	}
+	if s.expired(cmask.Round) {
+		return res, ErrRoundExpired
+	}
+	if s.hasDeparted(cmask.Id) {
+		return res, errDeparted(cmask.Id)
+	}
 	t := time.Now()
 	round := cmask.Round % MaxRounds
-	otherBlocks := make([][]byte, len(s.servers))
-	var wg sync.WaitGroup
-	for i := range otherBlocks {
-		if i == s.id {
-			otherBlocks[i] = make([]byte, BlockSize)
+
+	//a peer whose contribution never shows up fails the call after
+	//responseTimeout, rather than holding it forever
+	var timeout <-chan time.Time
+	if responseTimeout > 0 {
+		timer := time.NewTimer(responseTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	late := make(chan bool)
+	defer close(late)
+
+	traceLog(cmask.Trace, cmask.Round, "download for client %d at server %d", cmask.Id+clientIdBase, s.id)
+	defer func() {
+		if err != nil {
+			traceLog(cmask.Trace, cmask.Round, "download failed: %v", err)
 		} else {
-			wg.Add(1)
-			go func(i int, cmask ClientMask) {
-				defer wg.Done()
-				curBlock := <-s.rounds[round].xorsChan[i][cmask.Id]
-				otherBlocks[i] = curBlock.Block
-			}(i, cmask)
+			traceLog(cmask.Trace, cmask.Round, "download done from %d/%d servers", res.Contributions, res.Servers)
 		}
+	}()
+
+	//everyone else's share with -fanin 0, the subtrees' otherwise. every
+	//share is needed: each is the xor of the blocks under that server's mask,
+	//and the masks only select the client's block all together. no code over
+	//the shares can make up for a missing one, since redundancy would need
+	//some server to know another's mask, which is what keeps the slot private
+	children := s.xorChildren(cmask.Id)
+	otherBlocks := make([][]byte, len(children)+1)
+	var wg sync.WaitGroup
+	for j, i := range children {
+		wg.Add(1)
+		go func(j int, i int, cmask ClientMask) {
+			defer wg.Done()
+			otherBlocks[j], _ = s.contribution(cmask.Round, i, cmask.Id, late)
+		}(j, i, cmask)
+	}
+	got := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(got)
+	}()
+	select {
+	case <-got:
+	case <-timeout:
+		return res, fmt.Errorf("%v: round %d, contributions from other servers missing", ErrIncomplete, cmask.Round)
+	case <-s.aborted(cmask.Round):
+		return res, ErrRoundAborted
+	case <-s.ctx.Done():
+		return res, s.ctx.Err()
+	}
+	select {
+	case <-s.round(round).blocksRdy[cmask.Id]:
+	case <-timeout:
+		return res, fmt.Errorf("%v: round %d, blocks not ready", ErrIncomplete, cmask.Round)
+	case <-s.aborted(cmask.Round):
+		return res, ErrRoundAborted
+	case <-s.ctx.Done():
+		return res, s.ctx.Err()
 	}
-	wg.Wait()
-	<-s.rounds[round].blocksRdy[cmask.Id]
 	if cmask.Id == 0 && profile {
 		fmt.Println(cmask.Id, "down_network:", time.Since(t))
 	}
-	r := ComputeResponse(s.rounds[round].allBlocks, cmask.Mask, s.secretss[round][cmask.Id])
-	sha3.ShakeSum256(s.secretss[round][cmask.Id], s.secretss[round][cmask.Id])
-	Xor(Xors(otherBlocks), r)
-	*response = r
-	return nil
+	r, err := computeResponse(s.store, round, cmask.Mask, s.secretss[round][cmask.Id])
+	if err != nil {
+		return res, err
+	}
+	s.advanceChains(cmask.Round, cmask.Id, false)
+	otherBlocks[len(children)] = r
+	res.Block = ReconstructBlock(otherBlocks, nil)
+	PutBlock(r)
+	res.Round = cmask.Round
+	res.Servers = len(s.servers)
+	res.Contributions = 1
+	for _, i := range children {
+		res.Contributions += s.subtreeSize(cmask.Id, i)
+	}
+	res.Substituted = s.round(round).substitutions(cmask.Round)
+	res.Padded = s.round(round).paddings(cmask.Round)
+	if cmask.WithHashes && s.FSMode {
+		res.Hashes = s.round(round).upHashes
+	}
+	s.round(round).downloaded(cmask.Round)
+	s.respLatency.observe(time.Since(t))
+	return res, nil
 }
 
-func (s *Server) GetAllResponses(args *RequestArg, responses *[][]byte) error {
+func (s *Server) GetAllResponses(args *RequestArg, responses *[][]byte) (err error) {
+	defer recoverRPC("GetAllResponses", &err)
+	if !s.isEntry() {
+		return ErrNotEntry
+	}
+	args.Id, err = s.clientIndex(args.Id)
+	if err != nil {
+		return err
+	}
 	round := args.Round % MaxRounds
-	<-s.rounds[round].blocksRdy[args.Id]
+	select {
+	case <-s.round(round).blocksRdy[args.Id]:
+	case <-s.aborted(args.Round):
+		return ErrRoundAborted
+	}
 	resps := make([][]byte, s.totalClients)
-	for i := range s.rounds[round].allBlocks {
-		resps[i] = s.rounds[round].allBlocks[i].Block
+	for i := 0; i < s.store.numBlocks(round); i++ {
+		resps[i], err = s.store.block(round, i)
+		if err != nil {
+			return err
+		}
 	}
+	s.round(round).downloaded(args.Round)
 	*responses = resps
 	return nil
 }
 
 //used to push response for particular client
-func (s *Server) PutClientBlock(cblock ClientBlock, _ *int) error {
+func (s *Server) PutClientBlock(cblock ClientBlock, _ *int) (err error) {
+	defer recoverRPC("PutClientBlock", &err)
+	if cblock.SId < 0 || cblock.SId >= len(s.servers) {
+		return fmt.Errorf("Client block from unknown server %d", cblock.SId)
+	}
+	err = s.checkSlot(cblock.CId)
+	if err != nil {
+		return err
+	}
 	block := cblock.Block
+	if s.expired(block.Round) {
+		return ErrRoundExpired
+	}
 	round := block.Round % MaxRounds
-	s.rounds[round].xorsChan[cblock.SId][cblock.CId] <- block
+	select {
+	case s.round(round).xorsChan[cblock.SId][cblock.CId] <- block:
+	case <-s.aborted(block.Round):
+		return ErrRoundAborted
+	case <-s.ctx.Done():
+		return s.ctx.Err()
+	}
 	return nil
 }
 
+//server c's share of client i's response for round, or false once stop
+//closes or the round is aborted. A share that came too late for a round
+//given up on is still in the slot's channel, and is dropped here by the
+//next round that uses the slot
+func (s *Server) contribution(round uint64, c int, i int, stop chan bool) ([]byte, bool) {
+	ch := s.round(round % MaxRounds).xorsChan[c][i]
+	for {
+		select {
+		case b := <-ch:
+			if b.Round == round {
+				return b.Block, true
+			}
+			log.Printf("round %d: dropped server %d's share for client %d from round %d", round, c, i+clientIdBase, b.Round)
+		case <-stop:
+			return nil, false
+		case <-s.aborted(round):
+			return nil, false
+		case <-s.ctx.Done():
+			return nil, false
+		}
+	}
+}
+
 /////////////////////////////////
 //Misc
 ////////////////////////////////
 func (s *Server) verifyShuffle(ik InternalKey, aux AuxKeyProof) bool {
-	Xss := aux.OrigXss
-	Yss := aux.OrigYss
-	Xbarss := ik.Xss
-	Ybarss := ik.Ybarss
-	prfss := ik.Proofs
+	err := VerifyShuffle(s.suite, ik, aux)
+	if err != nil {
+		atomic.AddUint64(&s.proofsBad, 1)
+		log.Printf("round %d: shuffle verify failed: %v", ik.Round, err)
+		s.reportMisbehavior(ik, err)
+		return false
+	}
+	atomic.AddUint64(&s.proofsOK, 1)
+	return true
+}
 
-	for i := range Xss {
-		pk := UnmarshalPoint(s.suite, ik.Keys[i])
-		Xs := make([]abstract.Point, len(Xss[i]))
-		Ys := make([]abstract.Point, len(Yss[i]))
-		Xbars := make([]abstract.Point, len(Xbarss[i]))
-		Ybars := make([]abstract.Point, len(Ybarss[i]))
-		for j := range Xss[i] {
-			Xs[j] = UnmarshalPoint(s.suite, Xss[i][j])
-			Ys[j] = UnmarshalPoint(s.suite, Yss[i][j])
-			Xbars[j] = UnmarshalPoint(s.suite, Xbarss[i][j])
-			Ybars[j] = UnmarshalPoint(s.suite, Ybarss[i][j])
+//waits for every client's input, or once roundDeadline passes, for a quorum;
+//get(i, stop) blocks until client i's input arrives (true) or stop closes (false)
+func (s *Server) gather(round uint64, get func(int, chan bool) bool) []bool {
+	n := s.totalClients
+	got := make([]bool, n)
+	arrived := make(chan int, n)
+	stop := make(chan bool)
+	wg := startGets(n, get, stop, got, arrived)
+
+	need := int(math.Ceil(quorum * float64(n)))
+	var deadline <-chan time.Time
+	if roundDeadline > 0 {
+		deadline = time.After(roundDeadline)
+	}
+	in := make([]bool, n)
+	late := false
+	var lateAt time.Time
+	count := 0
+L:
+	for count < n {
+		if late && count >= need && deadline == nil {
+			wait := s.holdout(in, lateAt)
+			if wait <= 0 {
+				break
+			}
+			deadline = time.After(wait)
 		}
-		v := shuffle.Verifier(s.suite, nil, pk, Xs, Ys, Xbars, Ybars)
-		err := proof.HashVerify(s.suite, "PairShuffle", v, prfss[i])
-		if err != nil {
-			log.Println("Shuffle verify failed: ", err)
-			return false
+		select {
+		case i := <-arrived:
+			in[i] = true
+			count++
+		case <-deadline:
+			if !late {
+				late, lateAt = true, time.Now()
+			}
+			deadline = nil
+		case <-s.aborted(round):
+			break L
+		case <-s.ctx.Done():
+			break L
 		}
 	}
-	return true
+	close(stop)
+	wg.Wait()
+	if count < n && s.ctx.Err() == nil && !s.aborts.is(round) {
+		log.Printf("round %d: proceeding with %d/%d clients", round, count, n)
+	}
+	return got
 }
 
-func (s *Server) shuffle(input [][]byte, round uint64) {
+//how much longer the highest priority client not in yet is still waited on,
+//past a deadline that passed at lateAt
+func (s *Server) holdout(in []bool, lateAt time.Time) time.Duration {
+	s.regLock[1].Lock()
+	defer s.regLock[1].Unlock()
+	var wait time.Duration
+	for i, p := range s.priorities {
+		if i < len(in) && !in[i] {
+			if w := time.Until(lateAt.Add(time.Duration(p) * priorityGrace)); w > wait {
+				wait = w
+			}
+		}
+	}
+	return wait
+}
+
+//like gather, but takes whatever arrived once window is up and returns
+//only then, even if everyone was in early
+func (s *Server) gatherWindow(round uint64, window time.Duration, get func(int, chan bool) bool) []bool {
+	end := time.After(window)
+	n := s.totalClients
+	got := make([]bool, n)
+	arrived := make(chan int, n)
+	stop := make(chan bool)
+	wg := startGets(n, get, stop, got, arrived)
+
+	count := 0
+L:
+	for count < n {
+		select {
+		case <-arrived:
+			count++
+		case <-end:
+			break L
+		case <-s.aborted(round):
+			break L
+		case <-s.ctx.Done():
+			break L
+		}
+	}
+	close(stop)
+	wg.Wait()
+	if count < n {
+		if s.ctx.Err() == nil && !s.aborts.is(round) {
+			log.Printf("round %d: window closed with %d/%d clients", round, count, n)
+		}
+		return got
+	}
+	select {
+	case <-end:
+	case <-s.aborted(round):
+	case <-s.ctx.Done():
+	}
+	return got
+}
+
+//fills the slots of missing clients with zero blocks the same size as the rest
+//a stand in for a missing client's size byte upload as it looks at this
+//hop, or nil when dummy traffic is off
+func (s *Server) dummyBlock(size int) []byte {
+	if !dummyTraffic {
+		return nil
+	}
+	return s.randomBlock(size)
+}
+
+//random bytes the size of a size byte upload as it looks at this hop
+func (s *Server) randomBlock(size int) []byte {
+	b := make([]byte, size+(len(s.servers)-s.id)*secretbox.Overhead)
+	s.newRand().XORKeyStream(b, b)
+	return b
+}
+
+func padDummies(blocks [][]byte) {
+	size := BlockSize
+	for i := range blocks {
+		if len(blocks[i]) != 0 {
+			size = len(blocks[i])
+			break
+		}
+	}
+	for i := range blocks {
+		if len(blocks[i]) == 0 {
+			blocks[i] = make([]byte, size)
+		}
+	}
+}
+
+//opens this server's layer of every input in place; padded ones (nil for
+//none) were never sealed and go on like a dropped block, uncounted
+func (s *Server) shuffle(input [][]byte, padded []bool, round uint64) {
 	tmp := make([]byte, 24)
 	nonce := [24]byte{}
 	binary.PutUvarint(tmp, round)
 	copy(nonce[:], tmp[:])
+	ks := s.keyShuffle(round)
+	openLimit := newLimiter(decryptWorkers)
 	var aesWG sync.WaitGroup
 	for i := 0; i < s.totalClients; i++ {
 		aesWG.Add(1)
 		go func(i int) {
 			defer aesWG.Done()
+			if len(input[i]) == 0 { //dummy for a missing client
+				return
+			}
+			n := len(input[i])
+			if padded != nil && padded[i] {
+				input[i] = s.unopened(n)
+				return
+			}
+			openLimit.acquire()
+			defer openLimit.release()
 			key := [32]byte{}
-			copy(key[:], s.keys[i][:])
+			copy(key[:], ks.keys[i][:])
 			var good bool
 			input[i], good = secretbox.Open(nil, input[i], &nonce, &key)
-			if !good {
-				log.Fatal(round, " check failed:", s.id, i)
+			if good {
+				return
+			}
+			s.round(round % MaxRounds).substitute(round)
+			//one bad box only costs its sender the round
+			input[i] = s.unopened(n)
+			if input[i] == nil {
+				log.Printf("round %d: slot %d failed to open on server %d, dropping it", round, i, s.id)
 			}
 		}(i)
 	}
 	aesWG.Wait()
 }
 
-func Shuffle(pi []int, group abstract.Group, g, h abstract.Point, X, Y []abstract.Point,
-	rand cipher.Stream) (XX, YY []abstract.Point, P proof.Prover) {
+//what goes on in place of an n byte input that wasn't opened: with dummy
+//traffic, random bytes of the size it would have opened to, since a random
+//dummy can't be told from a bad block once shuffled; otherwise nil
+func (s *Server) unopened(n int) []byte {
+	if !dummyTraffic || n < secretbox.Overhead {
+		return nil
+	}
+	b := make([]byte, n-secretbox.Overhead)
+	s.newRand().XORKeyStream(b, b)
+	return b
+}
+
+func readSeed(random io.Reader) []byte {
+	seed := make([]byte, SecretSize)
+	_, err := io.ReadFull(random, seed)
+	if err != nil {
+		log.Fatal("Couldn't read randomness: ", err)
+	}
+	return seed
+}
+
+//fresh stream keyed from randSource, in place of Cipher(abstract.RandomKey)
+func (s *Server) newRand() abstract.Cipher {
+	return s.suite.Cipher(readSeed(s.randSource))
+}
+
+//turns a panic in an rpc handler into an error for the caller, so one bad
+//message doesn't take the whole server down
+func recoverRPC(method string, err *error) {
+	if r := recover(); r != nil {
+		stack := make([]byte, 64<<10)
+		stack = stack[:runtime.Stack(stack, false)]
+		log.Printf("%s panicked: %v\n%s", method, r, stack)
+		*err = fmt.Errorf("%s failed: %v", method, r)
+	}
+}
+
+//a round slot, with its per client channels allocated on first use
+//rather than all up front during registration
+func (s *Server) round(rnd uint64) *Round {
+	r := s.rounds[rnd]
+	r.setupOnce.Do(func() {
+		r.setup(s.totalClients, len(s.servers))
+	})
+	return r
+}
+
+func (r *Round) setup(numClients int, numServers int) {
+	if RoundKeys {
+		r.keyShuffle = newKeyShuffle(numClients, numServers)
+	}
+
+	for i := 0; i < numServers; i++ {
+		r.xorsChan[i] = make(map[int](chan Block))
+		for j := 0; j < numClients; j++ {
+			//room for a share that comes after its round was given up on,
+			//so its sender isn't stuck until the slot is used again
+			r.xorsChan[i][j] = make(chan Block, 1)
+		}
+	}
+
+	r.requestsChan = make(chan []Request)
+	r.reqHashes = make([][]byte, numClients)
+
+	r.reqChan2 = make([]chan Request, numClients)
+	r.upHashes = make([][]byte, numClients)
+	r.blocksRdy = make([]chan bool, numClients)
+	r.downloads = make(chan uint64, numClients)
+	r.uploaded = make([]uint64, numClients)
+	r.reqHashesRdy = make([]chan bool, numClients)
+	r.ublockChan2 = make([]chan Block, numClients)
+	for i := range r.blocksRdy {
+		r.reqChan2[i] = make(chan Request)
+		r.blocksRdy[i] = make(chan bool)
+		r.reqHashesRdy[i] = make(chan bool)
+		r.ublockChan2[i] = make(chan Block)
+	}
+}
+
+//moves a phase of the slot on to round
+func (r *Round) activate(active *uint64, round uint64) {
+	r.activeLock.Lock()
+	*active = round
+	r.activeCond.Broadcast()
+	r.activeLock.Unlock()
+}
+
+//waits for the slot's phase to reach round; messages for a round the
+//slot already moved past are rejected rather than handed to the wrong round
+func (r *Round) enter(active *uint64, round uint64) error {
+	r.activeLock.Lock()
+	defer r.activeLock.Unlock()
+	for *active < round && !r.halted {
+		r.activeCond.Wait()
+	}
+	if r.halted {
+		return ErrRoundAborted
+	}
+	if *active != round {
+		return fmt.Errorf("%v: round %d, slot is at round %d", ErrRoundExpired, round, *active)
+	}
+	return nil
+}
+
+//counts a block of round this server couldn't open
+func (r *Round) substitute(round uint64) {
+	r.activeLock.Lock()
+	r.countFor(round)
+	r.subs++
+	r.activeLock.Unlock()
+}
+
+func (r *Round) substitutions(round uint64) int {
+	r.activeLock.Lock()
+	defer r.activeLock.Unlock()
+	if r.subRound != round+1 {
+		return 0
+	}
+	return r.subs
+}
+
+//counts n requests of round padded in for clients the window closed on;
+//they're not substitutions, nobody sent anything bad
+func (r *Round) pad(round uint64, n int) {
+	r.activeLock.Lock()
+	r.countFor(round)
+	r.pads += n
+	r.activeLock.Unlock()
+}
+
+func (r *Round) paddings(round uint64) int {
+	r.activeLock.Lock()
+	defer r.activeLock.Unlock()
+	if r.subRound != round+1 {
+		return 0
+	}
+	return r.pads
+}
+
+//starts the counts over once the slot moves on to round; activeLock has to
+//be held
+func (r *Round) countFor(round uint64) {
+	if r.subRound != round+1 {
+		r.subRound = round + 1
+		r.subs = 0
+		r.pads = 0
+	}
+}
+
+//marks client i's block for round taken; false if it already was, so a
+//retried upload succeeds without being queued a second time
+func (r *Round) firstUpload(i int, round uint64) bool {
+	r.activeLock.Lock()
+	defer r.activeLock.Unlock()
+	if r.uploaded[i] == round+1 {
+		return false
+	}
+	r.uploaded[i] = round + 1
+	return true
+}
+
+//waits for the slot's phase to reach at least round, or for the round
+//it's waiting on to be aborted
+func (r *Round) await(active *uint64, round uint64) {
+	r.activeLock.Lock()
+	for *active < round && r.aborted < round && !r.halted {
+		r.activeCond.Wait()
+	}
+	r.activeLock.Unlock()
+}
+
+//steps client i's secret chain, and its mask chain too when this server
+//answers for it (mask), past round. Every chain has to move exactly once a
+//round or the client's later rounds silently stop decoding, so a repeat
+//is refused and a gap is reported
+func (s *Server) advanceChains(round uint64, i int, mask bool) {
+	rnd := round % MaxRounds
+	var expected uint64 = 0
+	if round >= MaxRounds {
+		expected = round + 1 - MaxRounds
+	}
+	s.chainLock.Lock()
+	if s.departed[i] {
+		s.chainLock.Unlock()
+		return
+	}
+	last := s.chainRound[rnd][i]
+	if last == round+1 {
+		s.chainLock.Unlock()
+		atomic.AddUint64(&s.chainErrors, 1)
+		log.Printf("round %d: chains of client %d already advanced", round, i+clientIdBase)
+		return
+	}
+	if last != expected {
+		atomic.AddUint64(&s.chainErrors, 1)
+		log.Printf("round %d: chains of client %d last advanced in round %d", round, i+clientIdBase, int64(last)-1)
+	}
+	s.chainRound[rnd][i] = round + 1
+	s.chainLock.Unlock()
+
+	sha3.ShakeSum256(s.secretss[rnd][i], s.secretss[rnd][i])
+	if mask {
+		sha3.ShakeSum256(s.maskss[rnd][i], s.maskss[rnd][i])
+	}
+}
+
+//phases only move forward, since handlers for the same round run concurrently
+func (s *Server) setPhase(round uint64, phase int) {
+	s.progressLock.Lock()
+	p, ok := s.phases[round]
+	if !ok {
+		s.started[round] = time.Now()
+	}
+	if !ok || phase > p {
+		s.phases[round] = phase
+		if logPhases {
+			log.Printf("round %d: %s", round, phaseNames[phase])
+		}
+	}
+	s.progressLock.Unlock()
+}
+
+func (s *Server) finishRound(round uint64) {
+	s.releaseRound(round)
+	if round >= MaxRounds {
+		s.aborts.forget(round - MaxRounds + 1)
+	}
+	s.progressLock.Lock()
+	s.checkSlowRound(round)
+	var sum *RoundSummary
+	if s.summaries != nil {
+		sum = s.summarize(round)
+	}
+	delete(s.phases, round)
+	delete(s.started, round)
+	delete(s.timings, round)
+	s.completed++
+	s.degraded.tick()
+	flushTiming()
+	if logPhases {
+		log.Printf("round %d: done", round)
+	}
+	if s.completed == maxTotalRounds {
+		close(s.finished)
+	}
+	if round > s.highest {
+		s.highest = round
+	}
+	s.progressLock.Unlock()
+	if sum != nil {
+		s.summaries.send(sum)
+	}
+}
+
+//index of a client id handed out by Register
+func (s *Server) clientIndex(id int) (int, error) {
+	i := id - clientIdBase
+	if i < 0 || i >= s.totalClients {
+		return 0, fmt.Errorf("Unknown client id %d", id)
+	}
+	return i, nil
+}
 
-	k := len(X)
-	if k != len(Y) {
-		panic("X,Y vectors have inconsistent length")
+//the hashes of a round are only handed to the clients mapped to this
+//server; anyone else would wait on them forever
+func (s *Server) checkMapped(i int) error {
+	sid, ok := s.clientMap[i]
+	if ok && sid != s.id {
+		return fmt.Errorf("Client %d is served by server %d", i+clientIdBase, sid)
 	}
+	return nil
+}
 
-	ps := shuffle.PairShuffle{}
-	ps.Init(group, k)
+//internal client index i, as passed between servers
+func (s *Server) checkSlot(i int) error {
+	if i < 0 || i >= s.totalClients {
+		return fmt.Errorf("Bad client slot %d", i)
+	}
+	return nil
+}
 
-	// Pick a fresh ElGamal blinding factor for each pair
-	beta := make([]abstract.Scalar, k)
-	for i := 0; i < k; i++ {
-		beta[i] = group.Scalar().Pick(rand)
+//every batch handed between servers has one entry per client
+func (s *Server) checkBatch(n int) error {
+	if n != s.totalClients {
+		return fmt.Errorf("Batch of %d, expected %d", n, s.totalClients)
 	}
+	return nil
+}
 
-	// Create the output pair vectors
-	Xbar := make([]abstract.Point, k)
-	Ybar := make([]abstract.Point, k)
-	for i := 0; i < k; i++ {
-		Xbar[i] = group.Point().Mul(g, beta[pi[i]])
-		Xbar[i].Add(Xbar[i], X[pi[i]])
-		Ybar[i] = group.Point().Mul(h, beta[pi[i]])
-		Ybar[i].Add(Ybar[i], Y[pi[i]])
+//a shuffled key hop has KeyChunks rows per server from SId on, one key
+//per client
+func (s *Server) checkInternalKey(ik *InternalKey) error {
+	rows := (len(s.servers) - ik.SId) * KeyChunks
+	if len(ik.Xss) != rows || len(ik.Yss) != rows {
+		return fmt.Errorf("Key shuffle from server %d has the wrong number of rows", ik.SId)
+	}
+	for i := 0; i < rows; i++ {
+		if len(ik.Xss[i]) != s.totalClients || len(ik.Yss[i]) != s.totalClients {
+			return fmt.Errorf("Key shuffle from server %d has the wrong number of keys", ik.SId)
+		}
 	}
+	return nil
+}
+
+//a round's slot has been reused once a later round in the same slot finished
+func (s *Server) expired(round uint64) bool {
+	s.progressLock.Lock()
+	defer s.progressLock.Unlock()
+	return s.completed > 0 && round+MaxRounds <= s.highest
+}
 
-	prover := func(ctx proof.ProverContext) error {
-		return ps.Prove(pi, g, h, beta, X, Y, rand, ctx)
+//keeps one client from driving rounds far beyond everyone else's
+func (s *Server) checkAhead(round uint64) error {
+	if maxTotalRounds > 0 && round >= maxTotalRounds {
+		return fmt.Errorf("%v: round %d, last is %d", ErrLastRound, round, maxTotalRounds-1)
+	}
+	if maxRoundsAhead == 0 {
+		return nil
 	}
-	return Xbar, Ybar, prover
+	s.progressLock.Lock()
+	var next uint64 = 0
+	if s.completed > 0 {
+		next = s.highest + 1
+	}
+	s.progressLock.Unlock()
+	if round >= next+maxRoundsAhead {
+		return fmt.Errorf("%v: round %d, server is at round %d", ErrTooFarAhead, round, next)
+	}
+	return nil
+}
+
+//sealed blocks carry one secretbox per server, around the block and its hash
+func (s *Server) checkBlockSize(block *Block) error {
+	overhead := len(s.servers) * secretbox.Overhead
+	if len(block.Block) < BlockSize+overhead || len(block.Block) > BlockSize+HashSize+overhead {
+		return fmt.Errorf("%v: got %d bytes", ErrBadBlockSize, len(block.Block))
+	}
+	return nil
 }
 
-func runHandler(f func(uint64), rounds uint64) {
+type phaseTiming struct {
+	phase string
+	d     time.Duration
+}
+
+//one row per phase: round,phase,server,micros
+func (s *Server) logTiming(round uint64, phase string, d time.Duration) {
+	timingLock.Lock()
+	fmt.Fprintf(timingWriter, "%d,%s,%d,%d\n", round, phase, s.id, d.Nanoseconds()/1000)
+	timingLock.Unlock()
+	if slowRoundThreshold > 0 || s.summaries != nil {
+		s.progressLock.Lock()
+		s.timings[round] = append(s.timings[round], phaseTiming{phase, d})
+		s.progressLock.Unlock()
+	}
+}
+
+//gets the perf trace of every finished round out to the file
+func flushTiming() {
+	timingLock.Lock()
+	defer timingLock.Unlock()
+	if w, ok := timingWriter.(*bufio.Writer); ok {
+		w.Flush()
+	}
+	if timingSync && timingFile != nil {
+		timingFile.Sync()
+	}
+}
+
+//logs round if it ran over slowRoundThreshold; progressLock must be held
+func (s *Server) checkSlowRound(round uint64) {
+	if slowRoundThreshold == 0 {
+		return
+	}
+	var total time.Duration
+	if start, ok := s.started[round]; ok {
+		total = time.Since(start)
+	}
+	slow := total > slowRoundThreshold
+	breakdown := ""
+	for _, t := range s.timings[round] {
+		slow = slow || t.d > slowRoundThreshold
+		breakdown += fmt.Sprintf(" %s=%v", t.phase, t.d)
+	}
+	if slow {
+		log.Printf("round %d: WARN slow round on server %d took %v:%s", round, s.id, total, breakdown)
+	}
+}
+
+//runs f for every round, rounds of them at a time; a panic in f stops the
+//whole server
+func (s *Server) runHandler(f func(uint64), rounds uint64) {
 	var r uint64 = 0
 	for ; r < rounds; r++ {
-		go func(r uint64) {
-			for {
-				f(r)
+		r := r
+		s.spawn(func() {
+			for s.ctx.Err() == nil && (maxTotalRounds == 0 || r < maxTotalRounds) {
+				func() {
+					defer s.recoverHandler(r)
+					f(r)
+				}()
 				r += rounds
 			}
-		}(r)
+		})
+	}
+}
+
+//port part of a host:port server list entry
+func listenPort(addr string) int {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		log.Fatal("Bad server address ", addr, ": ", err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		log.Fatal("Bad port in server address ", addr, ": ", err)
 	}
+	return port
+}
+
+//profiles the first d of rounds, then writes the profile out while the
+//server keeps running
+func (s *Server) profileCPU(f *os.File, d time.Duration) {
+	select {
+	case <-s.regReady:
+	case <-s.ctx.Done():
+		return
+	}
+	pprof.StartCPUProfile(f)
+	select {
+	case <-time.After(d):
+	case <-s.ctx.Done():
+	}
+	pprof.StopCPUProfile()
+	f.Close()
+	fmt.Println(s.id, "cpu profile written")
 }
 
 func SetTotalClients(n int) {
@@ -1029,28 +2985,189 @@ func SetTotalClients(n int) {
 func main() {
 	runtime.GOMAXPROCS(runtime.NumCPU())
 	var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
+	var cpuDuration = flag.Duration("cpuprofile-duration", 0, "profile only this long once rounds start [0 for the whole run]")
+	var verifyVector = flag.String("verifyvector", "", "check a -keyvector file against this build and exit")
 	var memprofile = flag.String("memprofile", "", "write memory profile to this file")
+	var timing = flag.String("timing", "", "write shuffle phase timings to this file [csv]")
+	var storeDir = flag.String("store", "", "keep round blocks on disk in this dir instead of memory")
 	var id *int = flag.Int("i", 0, "id [num]")
-	var port1 *int = flag.Int("p1", 8000, "port1 [num]")
-	var servers *string = flag.String("s", "", "servers [file]")
+	var port1 *int = flag.Int("p1", 0, "port1 [num] (defaults to the port listed for this id in -s)")
+	var servers *string = flag.String("s", "", "servers [file, - for stdin, or set SERVERS=host:port,...]")
 	var numClients *int = flag.Int("n", 0, "num clients [num]")
 	var mode *string = flag.String("m", "", "mode [m for microblogging|f for file sharing]")
+	flag.BoolVar(&compressBlocks, "compress", false, "gzip blocks handed between servers")
+	flag.IntVar(&peerFailures, "peerfailures", 0, "servers a round's final broadcast can lose and carry on")
+	flag.DurationVar(&registerTimeout, "regtimeout", 0, "report registration stalled this long [0 for never]")
+	flag.DurationVar(&setupWait, "setupwait", 0, "give up registration if a server isn't set up for the clients this long after [0 for never]")
+	flag.DurationVar(&keyWait, "keywait", 0, "report clients that haven't uploaded keys after this long [0 for never]")
+	flag.StringVar(&missingKeys, "missingkeys", "wait", "after -keywait, what to do about missing keys [wait|abort|dummy]")
+	flag.BoolVar(&allowPartial, "partial", false, "start with the clients registered by -regtimeout")
+	flag.IntVar(&clientIdBase, "idbase", 0, "first client id this cluster hands out")
+	flag.Float64Var(&quorum, "quorum", 1, "fraction of clients a round settles for after -deadline")
+	flag.IntVar(&degradedRounds, "degradedrounds", 10, "rounds a server that dropped out is skipped before it's tried again [0 for never]")
+	flag.BoolVar(&timingBuffered, "timingbuf", false, "buffer -timing output, flushing it every round")
+	flag.StringVar(&summarySocket, "summarysock", "", "unix socket every finished round is sent to as a json line [empty for none]")
+	flag.BoolVar(&timingSync, "timingsync", false, "sync -timing output to disk every round")
+	flag.StringVar(&topology, "topology", "chain", "who broadcasts a shuffle's output: the last server (chain) or -ringcoord (ring)")
+	flag.IntVar(&ringCoordinator, "ringcoord", 0, "server that broadcasts shuffle output with -topology ring")
+	flag.DurationVar(&priorityGrace, "prioritygrace", 0, "past -deadline, how much longer each priority level of a missing client is waited on")
+	flag.DurationVar(&roundDeadline, "deadline", 0, "how long a round waits for all clients [0 for forever]")
+	var perm *string = flag.String("perm", "uniform", "permutation generator")
+	flag.BoolVar(&PoolBlocks, "poolblocks", false, "reuse response buffers across rounds")
+	flag.BoolVar(&logPhases, "logphases", false, "log each phase a round enters")
+	flag.Uint64Var(&maxTotalRounds, "totalrounds", 0, "stop after this many rounds, writing out profiles [0 for never]")
+	flag.IntVar(&peerConns, "peerconns", 1, "connections to each peer, used in turn")
+	flag.BoolVar(&debug, "debug", false, "allow exporting the permutation, never in production")
+	flag.IntVar(&xorFanIn, "fanin", 0, "most servers' response xors any one server combines, 0 for all at the client's server")
+	flag.StringVar(&archiveDir, "archive", "", "keep every completed round's blocks in this dir for later downloads")
+	flag.StringVar(&keyVectorFile, "keyvector", "", "write the first verified key shuffle to this file as a test vector")
+	flag.IntVar(&shuffleWorkers, "shuffleworkers", 0, "key shuffle rows shuffled at once [0 for all]")
+	flag.IntVar(&decryptWorkers, "decryptworkers", 0, "decryptions at once per key shuffle row or batch [0 for all]")
+	flag.IntVar(&gatherWorkers, "gatherworkers", 0, "goroutines waiting on client inputs per gather [0 for one per client]")
+	flag.IntVar(&XorWorkers, "xorworkers", 0, "response xors at once [0 for one per client, NumCPU when split]")
+	flag.IntVar(&regCoordinator, "coordinator", -1, "server that takes all registrations and sends out the client map once [-1 to broadcast each]")
+	flag.DurationVar(&slowRoundThreshold, "slowround", 0, "log rounds or phases slower than this, with their phase times [0 for never]")
+	flag.DurationVar(&downloadLatch, "dllatch", 0, "hold a finished round for up to this long until its clients downloaded it [0 to not wait]")
+	flag.Uint64Var(&maxRoundsAhead, "maxahead", 0, "rounds ahead of the server a client may send for [0 for no limit]")
+	flag.DurationVar(&requestWindow, "reqwindow", 0, "collect requests for exactly this long each round [0 to go once all are in]")
+	flag.Float64Var(&registerRate, "regrate", 0, "registrations per second per source [0 for unlimited]")
+	flag.IntVar(&registerBurst, "regburst", 1, "registration burst per source")
+	flag.IntVar(&auxConcurrency, "auxconc", 4, "peers the key shuffle proof is sent to at once")
+	flag.IntVar(&auxChunkSize, "auxchunk", 1024, "client keys per key shuffle proof chunk")
+	flag.BoolVar(&dummyTraffic, "dummies", false, "pad missing clients' uploads with random blocks")
+	flag.DurationVar(&tcpKeepAlive, "keepalive", 30*time.Second, "tcp keepalive period on accepted connections [0 for the OS default]")
+	flag.Int64Var(&maxMessageSize, "maxmsg", -1, "largest rpc message accepted, in bytes [0 for no limit, -1 for a batch of every client's block]")
+	flag.BoolVar(&inProcessSelf, "inproc", false, "call this server's own methods in memory instead of over loopback tcp")
+	flag.BoolVar(&roundBarrier, "barrier", false, "start each round only once every server has reached it")
+	var shuffleOnly *string = flag.String("shuffleonly", "", "ids of servers that only shuffle and take no clients, the same on every server and client [e.g. 1,3]")
+	flag.BoolVar(&RoundKeys, "roundkeys", false, "shuffle fresh client keys every round")
+	flag.DurationVar(&responseTimeout, "resptimeout", 0, "how long a download waits on other servers [0 for forever]")
+	flag.Uint64Var(&memHighWater, "memlimit", 0, "heap bytes past which new rounds are turned away [0 for no limit]")
+	flag.IntVar(&KeyChunks, "keychunks", 1, "points each client key is made of, shuffled in parallel")
+	flag.StringVar(&auditorURL, "auditor", "", "url shuffle verification failures are POSTed to [empty for none]")
+	flag.StringVar(&rpcCodec, "codec", "gob", "codec to ask other servers for [gob|binary]")
+	flag.StringVar(&HashFunc, "hash", "suite", "block hash [suite|sha3|blake2b]")
 	flag.Parse()
 
+	if *verifyVector != "" {
+		err := verifyVectorFile(*verifyVector)
+		if err != nil {
+			log.Fatal("Key shuffle vector doesn't verify: ", err)
+		}
+		fmt.Println("Key shuffle vector verifies")
+		return
+	}
+	if err := CheckHashFunc(HashFunc); err != nil {
+		log.Fatal(err)
+	}
+	if KeyChunks < 1 {
+		log.Fatal("Bad -keychunks: need at least one chunk per key")
+	}
+	if err := checkMissingKeys(missingKeys); err != nil {
+		log.Fatal(err)
+	}
+	if peerConns < 1 {
+		log.Fatal("Bad -peerconns: need at least one connection per peer")
+	}
+	if degradedRounds < 0 {
+		log.Fatal("Bad -degradedrounds: can't be negative")
+	}
+	gen, ok := permGens[*perm]
+	if !ok {
+		log.Fatal("Unknown permutation generator ", *perm)
+	}
+	permGen = gen
+	if debug {
+		log.Printf("WARN debug mode: this server's permutation can be exported")
+	}
+	if err := checkCodec(rpcCodec); err != nil {
+		log.Fatal(err)
+	}
+
+	var cpuFile *os.File
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
 			log.Fatal(err)
 		}
-		pprof.StartCPUProfile(f)
-		defer pprof.StopCPUProfile()
+		cpuFile = f
+		if *cpuDuration == 0 {
+			pprof.StartCPUProfile(f)
+			defer pprof.StopCPUProfile()
+		}
+	}
+
+	if *timing != "" {
+		f, err := os.Create(*timing)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		fmt.Fprintln(f, "round,phase,server,micros")
+		timingFile = f
+		timingWriter = f
+		if timingBuffered {
+			w := bufio.NewWriter(f)
+			defer flushTiming()
+			timingWriter = w
+		}
 	}
 
 	ss := ParseServerList(*servers)
+	if *id < 0 || *id >= len(ss) {
+		log.Fatalf("server id %d out of range (have %d servers)", *id, len(ss))
+	}
+	if err := checkTopology(len(ss)); err != nil {
+		log.Fatal(err)
+	}
+	ids, err := ParseShuffleOnly(*shuffleOnly, len(ss))
+	if err != nil {
+		log.Fatal("Bad -shuffleonly: ", err)
+	}
+	ShuffleOnly = ids
+	if regCoordinator >= len(ss) {
+		log.Fatalf("coordinator %d out of range (have %d servers)", regCoordinator, len(ss))
+	}
 
 	TotalClients = *numClients
+	if TotalClients <= 0 {
+		log.Fatal("Need at least one client [-n]")
+	}
+
+	//listen on the port this server is advertised under, unless overridden
+	if *port1 == 0 {
+		*port1 = listenPort(ss[*id])
+	}
+
+	s := NewServerContext(context.Background(), *port1, *id, ss, *mode == "f")
+
+	if *storeDir != "" {
+		store, err := newDiskStore(*storeDir, *id)
+		if err != nil {
+			log.Fatal("Couldn't create block store: ", err)
+		}
+		s.store = store
+	}
 
-	s := NewServer(*port1, *id, ss, *mode == "f")
+	if archiveDir != "" {
+		archive, err := newArchive(archiveDir, *id)
+		if err != nil {
+			log.Fatal("Couldn't create archive: ", err)
+		}
+		s.archive = archive
+	}
+
+	if summarySocket != "" {
+		feed, err := listenSummaries(summarySocket)
+		if err != nil {
+			log.Fatal("Couldn't listen for round summaries: ", err)
+		}
+		s.summaries = feed
+	}
+
+	if cpuFile != nil && *cpuDuration > 0 {
+		go s.profileCPU(cpuFile, *cpuDuration)
+	}
 
 	if *memprofile != "" {
 		f, err := os.Create(*memprofile)
@@ -1060,17 +3177,26 @@ func main() {
 		s.memProf = f
 	}
 
-	rpcServer1 := rpc.NewServer()
-	rpcServer1.Register(s)
-	l1, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port1))
+	err = s.Start()
 	if err != nil {
-		log.Fatal("Cannot starting listening to the port: ", err)
+		log.Fatal(err)
 	}
-	go rpcServer1.Accept(l1)
-	s.connectServers()
-	fmt.Println("Starting server", *id)
-	s.runHandlers()
 	fmt.Println("Handler running", *id)
 
-	Wait()
+	finished := s.finished
+	if maxTotalRounds == 0 {
+		finished = nil
+	}
+	select {
+	case <-finished:
+	case <-s.Failed():
+		s.Stop()
+		log.Fatal("Server failed: ", s.Err())
+	}
+	fmt.Println("Finished", maxTotalRounds, "rounds")
+	s.Stop()
+	if s.memProf != nil {
+		pprof.WriteHeapProfile(s.memProf)
+		s.memProf.Close()
+	}
 }
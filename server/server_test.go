@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/kwonalbert/riffle/lib"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/sha3"
+)
+
+//server id of servers, on its own, done registering clients; it isn't
+//connected to anyone, so only calls that stay on it work
+func registeredServer(t *testing.T, id, servers, clients int) *Server {
+	oldTotal := TotalClients
+	TotalClients = clients
+	s := NewServerContext(context.Background(), 0, id, make([]string, servers), true)
+	t.Cleanup(func() {
+		s.cancel()
+		TotalClients = oldTotal
+	})
+	err := s.RegisterDone2(clients, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-s.regReady
+	return s
+}
+
+//walks the hops of an n server key shuffle through keyHop: every server
+//but the first takes exactly the hop before it as input, every hop but the
+//last feeds an aux proof, and only server 0 hears the shuffle ended
+func TestKeyHopChain(t *testing.T) {
+	for n := 2; n <= 4; n++ {
+		servers := make([]string, n)
+		for sid := 0; sid < n; sid++ {
+			s := &Server{id: sid, servers: servers}
+			inputs := 0
+			for hop := 0; hop < n; hop++ {
+				a := s.keyHop(hop)
+				if a.myInput {
+					inputs++
+					if hop != sid-1 {
+						t.Errorf("%d servers: server %d takes hop %d as input", n, sid, hop)
+					}
+				}
+				if a.forwardAux != (hop < n-1) {
+					t.Errorf("%d servers: hop %d forwardAux is %v", n, hop, a.forwardAux)
+				}
+				if a.notifyClients != (hop == n-1 && sid == 0) {
+					t.Errorf("%d servers: server %d notifies clients after hop %d", n, sid, hop)
+				}
+			}
+			if sid > 0 && inputs != 1 {
+				t.Errorf("%d servers: server %d has %d inputs", n, sid, inputs)
+			}
+			if sid == 0 && inputs != 0 {
+				t.Errorf("%d servers: server 0 takes a hop as input", n)
+			}
+		}
+	}
+}
+
+//the whole key shuffle over 2, 3 and 4 servers: clients only get past
+//setup once it's done, and a round only opens if every server ended up
+//with the right keys
+func TestKeyShuffleChains(t *testing.T) {
+	for n := 2; n <= 4; n++ {
+		t.Run(fmt.Sprintf("%d servers", n), func(t *testing.T) {
+			_, tcs := startCluster(t, n, 3, 1)
+			in, out := runRound(t, tcs, 0)
+			matchOutputs(t, in, out)
+		})
+	}
+}
+
+//client 0 is served every round, client 1 sits out (or loses to an abort)
+//one round of each slot, and client 2 is served twice in round 0: every
+//advance is exactly one hash step, and each skip or repeat is counted
+func TestAdvanceChains(t *testing.T) {
+	s := registeredServer(t, 0, 2, 3)
+	const skipped = MaxRounds + 3
+	step := func(b []byte) []byte {
+		next := make([]byte, len(b))
+		sha3.ShakeSum256(next, b)
+		return next
+	}
+
+	for round := uint64(0); round < 3*MaxRounds; round++ {
+		rnd := round % MaxRounds
+		for i := 0; i < 3; i++ {
+			if i == 1 && round == skipped {
+				continue
+			}
+			mask := append([]byte{}, s.maskss[rnd][i]...)
+			secret := append([]byte{}, s.secretss[rnd][i]...)
+			s.advanceChains(round, i, true)
+			if !bytes.Equal(s.maskss[rnd][i], step(mask)) || !bytes.Equal(s.secretss[rnd][i], step(secret)) {
+				t.Fatalf("round %d: chains of client %d didn't advance one step", round, i)
+			}
+			if i == 2 && round == 0 {
+				s.advanceChains(round, i, true)
+				if !bytes.Equal(s.secretss[rnd][i], step(secret)) {
+					t.Fatalf("round %d: chains of client %d advanced twice", round, i)
+				}
+			}
+		}
+	}
+	//the repeat in round 0, and the round after the skip finding its slot behind
+	if n := atomic.LoadUint64(&s.chainErrors); n != 2 {
+		t.Fatalf("%d chain errors counted, expected 2", n)
+	}
+}
+
+//calls from clients, pipes or TCP, are told apart from calls from servers
+//in the server list
+func TestFromPeer(t *testing.T) {
+	s := &Server{
+		servers:   []string{"127.0.0.1:8000", "[::1]:8001", "10.0.0.2:8002"},
+		peerAddrs: newPeerAddrs(),
+	}
+	for source, peer := range map[string]bool{
+		"self":      true,
+		"cluster":   true,
+		"client":    false,
+		"127.0.0.1": true,
+		"::1":       true,
+		"10.0.0.2":  true,
+		"10.0.0.3":  false,
+		"localhost": false,
+	} {
+		c := &connServer{Server: s, source: source}
+		if c.fromPeer() != peer {
+			t.Errorf("%s: fromPeer is %v", source, !peer)
+		}
+	}
+	//resolved once: the list isn't looked at again
+	s.servers = nil
+	if c := (&connServer{Server: s, source: "10.0.0.2"}); !c.fromPeer() {
+		t.Error("peer forgotten once the list was resolved")
+	}
+}
+
+func TestAbortRoundFromClient(t *testing.T) {
+	s := registeredServer(t, 0, 2, 3)
+	c := &connServer{Server: s, source: "client"}
+	if err := c.AbortRound(0, nil); err != ErrNotPeer {
+		t.Fatalf("client aborting got %v", err)
+	}
+	select {
+	case <-s.aborted(0):
+		t.Fatal("client aborted round 0")
+	default:
+	}
+}
+
+func TestPutClientMapFromClient(t *testing.T) {
+	s := registeredServer(t, 0, 2, 3)
+	c := &connServer{Server: s, source: "client"}
+	clientMap := ClientMap{Servers: map[int]int{0: 1}}
+	if err := c.PutClientMap(&clientMap, nil); err != ErrNotPeer {
+		t.Fatalf("client sending a client map got %v", err)
+	}
+	if err := c.checkMapped(0); err != nil {
+		t.Fatalf("client's map was taken: %v", err)
+	}
+}
+
+//the handlers only servers call turn clients away before doing anything
+func TestPeerOnlyFromClient(t *testing.T) {
+	c := &connServer{Server: &Server{peerAddrs: newPeerAddrs()}, source: "client"}
+	for method, call := range map[string]func() error{
+		"CollectRequests": func() error { return c.CollectRequests(&[]Request{}, nil) },
+		"CollectBlocks":   func() error { return c.CollectBlocks(&BlockBatch{}, nil) },
+		"StartRound":      func() error { return c.StartRound(&RoundStart{}, nil) },
+		"PutAuxChunk":     func() error { return c.PutAuxChunk(&AuxKeyChunk{}, nil) },
+	} {
+		if err := call(); err != ErrNotPeer {
+			t.Errorf("client calling %s got %v", method, err)
+		}
+	}
+}
+
+//buckets of sources that went quiet are dropped once they've refilled,
+//while a source that's still spent stays limited
+func TestRateLimiterSweep(t *testing.T) {
+	rl := newRateLimiter(100, 1)
+	for i := 0; i < 50; i++ {
+		if !rl.allow(fmt.Sprintf("10.0.0.%d", i)) {
+			t.Fatalf("source %d limited on its first call", i)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if !rl.allow("10.0.1.0") {
+		t.Fatal("new source limited")
+	}
+	if rl.allow("10.0.1.0") {
+		t.Fatal("spent source allowed")
+	}
+	if len(rl.buckets) != 1 {
+		t.Fatalf("%d buckets left, want only the spent one", len(rl.buckets))
+	}
+}
+
+//a server listed in -shuffleonly turns clients away itself, and no other
+//server registers clients to it either
+func TestRegisterShuffleOnly(t *testing.T) {
+	oldShuffleOnly := ShuffleOnly
+	ShuffleOnly = []int{1}
+	defer func() { ShuffleOnly = oldShuffleOnly }()
+	entry := NewServerContext(context.Background(), 0, 0, make([]string, 2), false)
+	defer entry.cancel()
+	shuffler := NewServerContext(context.Background(), 0, 1, make([]string, 2), false)
+	defer shuffler.cancel()
+
+	var reply RegisterReply
+	if err := shuffler.TryRegister(0, &reply); err != ErrNotEntry {
+		t.Fatalf("registering at a shuffle-only server got %v", err)
+	}
+	err := entry.TryRegister(1, &reply)
+	if err == nil || !strings.Contains(err.Error(), "only shuffles") {
+		t.Fatalf("registering to a shuffle-only server got %v", err)
+	}
+	if entry.totalClients != 0 {
+		t.Fatalf("%d clients registered", entry.totalClients)
+	}
+}
+
+//a key upload that isn't all valid points is refused, naming the client,
+//before it can reach the shuffle
+func TestUploadKeysBadPoint(t *testing.T) {
+	s := registeredServer(t, 0, 2, 3)
+	rows := 2 * KeyChunks
+	key := UpKey{
+		C1s: make([][]byte, rows),
+		C2s: make([][]byte, rows),
+		Id:  clientIdBase + 1,
+	}
+	for row := range key.C1s {
+		key.C1s[row] = MarshalPoint(s.pk)
+		key.C2s[row] = MarshalPoint(s.pk)
+	}
+	key.C2s[rows-1] = MarshalPoint(s.g.Point().Null())
+	err := s.UploadKeys(&key, nil)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("client %d", clientIdBase+1)) {
+		t.Fatalf("upload with the identity point got %v", err)
+	}
+}
+
+//a share that arrives after its round was given up on doesn't hold up its
+//sender, and the next round of the slot skips it for its own
+func TestLateContribution(t *testing.T) {
+	s := registeredServer(t, 0, 2, 3)
+	stale := ClientBlock{CId: 2, SId: 1, Block: Block{Block: []byte{1}, Round: 0}}
+	err := s.PutClientBlock(stale, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := ClientBlock{CId: 2, SId: 1, Block: Block{Block: []byte{2}, Round: MaxRounds}}
+	go s.PutClientBlock(fresh, nil)
+	b, ok := s.contribution(MaxRounds, 1, 2, nil)
+	if !ok || !bytes.Equal(b, fresh.Block.Block) {
+		t.Fatalf("round %d got share %v", MaxRounds, b)
+	}
+}
+
+//a peer that records the calls made to it and answers all of them
+type recorder struct {
+	lock    sync.Mutex
+	methods []string
+	args    []interface{}
+}
+
+func (r *recorder) Call(method string, args interface{}, reply interface{}) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.methods = append(r.methods, method)
+	r.args = append(r.args, args)
+	return nil
+}
+
+//server 1 of 4 opens its layer of round 0's uploads in pi's order and
+//hands them to server 2 alone
+func TestShuffleUploadsHandoff(t *testing.T) {
+	const clients = 3
+	s := registeredServer(t, 1, 4, clients)
+	peers := make([]*recorder, len(s.servers))
+	s.rpcServers = make([]caller, len(s.servers))
+	for i := range peers {
+		peers[i] = new(recorder)
+		s.rpcServers[i] = peers[i]
+	}
+
+	nonce := [24]byte{}
+	binary.PutUvarint(nonce[:], 0)
+	ks := s.keyShuffle(0)
+	plain := make([][]byte, clients)
+	blocks := make([]Block, clients)
+	for i := 0; i < clients; i++ {
+		key := [32]byte{byte(i + 1)}
+		ks.keys[i] = key[:]
+		plain[i] = bytes.Repeat([]byte{byte(i + 1)}, BlockSize)
+		blocks[s.pi[i]] = Block{Block: secretbox.Seal(nil, plain[i], &nonce, &key), Round: 0}
+	}
+	go func() {
+		s.round(0).shuffleChan <- blocks
+	}()
+	s.shuffleUploads(0)
+
+	for i, p := range peers {
+		want := 0
+		if i == s.id+1 {
+			want = 1
+		}
+		if len(p.methods) != want {
+			t.Fatalf("server %d got %v", i, p.methods)
+		}
+	}
+	next := peers[s.id+1]
+	if next.methods[0] != "Server.ShareServerBlocks" {
+		t.Fatalf("server %d got %s", s.id+1, next.methods[0])
+	}
+	got, err := next.args[0].(*BlockBatch).Unpack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range plain {
+		if !bytes.Equal(got[i].Block, plain[i]) || got[i].Round != 0 {
+			t.Fatalf("block %d isn't client slot %d's, opened", i, i)
+		}
+	}
+}
+
+//requests padded in when -reqwindow closes count as padding, and go
+//through the shuffle without counting as substitutions
+func TestWindowPadding(t *testing.T) {
+	oldWindow := requestWindow
+	requestWindow = 10 * time.Millisecond
+	defer func() { requestWindow = oldWindow }()
+	const clients = 3
+	s := registeredServer(t, 0, 2, clients)
+	go s.gatherRequests(0)
+
+	var reqs []Request
+	select {
+	case reqs = <-s.round(0).requestsChan:
+	case <-time.After(time.Second):
+		t.Fatal("window never closed")
+	}
+	input := make([][]byte, clients)
+	padded := make([]bool, clients)
+	for i, req := range reqs {
+		input[i] = req.Hash
+		padded[i] = req.Id == paddedId
+		if !padded[i] {
+			t.Fatalf("slot %d wasn't padded", i)
+		}
+	}
+	s.shuffle(input, padded, 0)
+	if n := s.round(0).paddings(0); n != clients {
+		t.Fatalf("%d requests counted as padding", n)
+	}
+	if n := s.round(0).substitutions(0); n != 0 {
+		t.Fatalf("%d padded requests counted as substituted", n)
+	}
+}
+
+//an upload for round 0 that comes before the round's request hashes are
+//published waits in enter, and is only gathered once PutPlainRequests is in
+func TestUploadsAfterRequestHashes(t *testing.T) {
+	const clients = 3
+	s := registeredServer(t, 0, 2, clients)
+	go s.gatherUploads(0)
+
+	uploaded := make(chan error, 1)
+	go func() {
+		uploaded <- s.UploadBlock2(&Block{Block: make([]byte, BlockSize), Round: 0, Id: 0}, nil)
+	}()
+	select {
+	case err := <-uploaded:
+		t.Fatalf("upload went through before the request hashes: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	reqs := make([]Request, clients)
+	for i := range reqs {
+		reqs[i] = Request{Hash: make([]byte, HashSize), Round: 0}
+	}
+	err := s.PutPlainRequests(&reqs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-uploaded:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("upload still waiting after the request hashes were published")
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	. "github.com/kwonalbert/riffle/lib" //types and utils
+)
+
+//where a round's shuffled blocks live until the round slot is reused
+type blockStore interface {
+	put(rnd uint64, blocks []Block) error
+	block(rnd uint64, i int) ([]byte, error)
+	numBlocks(rnd uint64) int
+}
+
+//default: keep everything in memory
+type memStore struct {
+	rounds [][]Block
+}
+
+func newMemStore() *memStore {
+	return &memStore{rounds: make([][]Block, MaxRounds)}
+}
+
+func (m *memStore) put(rnd uint64, blocks []Block) error {
+	m.rounds[rnd] = blocks
+	return nil
+}
+
+func (m *memStore) block(rnd uint64, i int) ([]byte, error) {
+	return m.rounds[rnd][i].Block, nil
+}
+
+func (m *memStore) numBlocks(rnd uint64) int {
+	return len(m.rounds[rnd])
+}
+
+//spills each round slot to a file of fixed size records,
+//so block sets larger than memory can still be served
+type diskStore struct {
+	files []*os.File
+	sizes []int //record size per round slot
+	nums  []int
+	lock  *sync.RWMutex
+}
+
+func newDiskStore(dir string, id int) (*diskStore, error) {
+	d := &diskStore{
+		files: make([]*os.File, MaxRounds),
+		sizes: make([]int, MaxRounds),
+		nums:  make([]int, MaxRounds),
+		lock:  new(sync.RWMutex),
+	}
+	for r := range d.files {
+		f, err := os.Create(filepath.Join(dir, fmt.Sprintf("server%d-round%d", id, r)))
+		if err != nil {
+			return nil, err
+		}
+		d.files[r] = f
+	}
+	return d, nil
+}
+
+func (d *diskStore) put(rnd uint64, blocks []Block) error {
+	size := 0
+	if len(blocks) > 0 {
+		size = len(blocks[0].Block)
+	}
+	buf := make([]byte, len(blocks)*size)
+	for i := range blocks {
+		if len(blocks[i].Block) != size {
+			return errors.New("Blocks of a round must all be the same size")
+		}
+		copy(buf[i*size:], blocks[i].Block)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	_, err := d.files[rnd].WriteAt(buf, 0)
+	if err != nil {
+		return err
+	}
+	d.sizes[rnd] = size
+	d.nums[rnd] = len(blocks)
+	return nil
+}
+
+func (d *diskStore) block(rnd uint64, i int) ([]byte, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	if i >= d.nums[rnd] {
+		return nil, fmt.Errorf("No block %d in round slot %d", i, rnd)
+	}
+	b := make([]byte, d.sizes[rnd])
+	_, err := d.files[rnd].ReadAt(b, int64(i*d.sizes[rnd]))
+	return b, err
+}
+
+func (d *diskStore) numBlocks(rnd uint64) int {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.nums[rnd]
+}
+
+//xor of the blocks selected by mask, read through the store
+func computeResponse(store blockStore, rnd uint64, mask []byte, secret []byte) ([]byte, error) {
+	var err error
+	res := ComputeResponseFunc(store.numBlocks(rnd), func(i int) []byte {
+		b, e := store.block(rnd, i)
+		if e != nil {
+			err = e
+			return make([]byte, BlockSize)
+		}
+		return b
+	}, mask, secret)
+	return res, err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	. "github.com/kwonalbert/riffle/lib"
+)
+
+//unix socket readers get a json line per finished round on [empty for none]
+var summarySocket = ""
+
+//how long a reader gets to take a summary before it's dropped
+const summaryTimeout = time.Second
+
+//the readers connected to the summary socket
+type summaryFeed struct {
+	lock    *sync.Mutex
+	l       net.Listener
+	readers []net.Conn
+}
+
+func listenSummaries(path string) (*summaryFeed, error) {
+	//a socket left behind by an earlier run would make the listen fail
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	f := &summaryFeed{
+		lock: new(sync.Mutex),
+		l:    l,
+	}
+	go f.accept()
+	return f, nil
+}
+
+func (f *summaryFeed) accept() {
+	for {
+		conn, err := f.l.Accept()
+		if err != nil {
+			return
+		}
+		f.lock.Lock()
+		f.readers = append(f.readers, conn)
+		f.lock.Unlock()
+	}
+}
+
+//writes sum to every reader, dropping the ones that can't keep up
+func (f *summaryFeed) send(sum *RoundSummary) {
+	line, err := json.Marshal(sum)
+	if err != nil {
+		log.Printf("round %d: couldn't encode summary: %v", sum.Round, err)
+		return
+	}
+	line = append(line, '\n')
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	live := f.readers[:0]
+	for _, conn := range f.readers {
+		conn.SetWriteDeadline(time.Now().Add(summaryTimeout))
+		_, err := conn.Write(line)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+		live = append(live, conn)
+	}
+	f.readers = live
+}
+
+func (f *summaryFeed) Close() error {
+	err := f.l.Close()
+	f.lock.Lock()
+	for _, conn := range f.readers {
+		conn.Close()
+	}
+	f.readers = nil
+	f.lock.Unlock()
+	return err
+}
+
+//round as it stands when it finishes; progressLock must be held
+func (s *Server) summarize(round uint64) *RoundSummary {
+	sum := &RoundSummary{
+		Round:       round,
+		Server:      s.id,
+		Clients:     s.totalClients,
+		Substituted: s.round(round % MaxRounds).substitutions(round),
+		Padded:      s.round(round % MaxRounds).paddings(round),
+		Aborted:     s.aborts.is(round),
+		Phases:      make(map[string]int64),
+	}
+	if start, ok := s.started[round]; ok {
+		sum.Micros = time.Since(start).Nanoseconds() / 1000
+	}
+	for _, t := range s.timings[round] {
+		sum.Phases[t.phase] += t.d.Nanoseconds() / 1000
+	}
+	return sum
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+
+	. "github.com/kwonalbert/riffle/lib" //types and utils
+)
+
+//how a shuffle's output gets out once the last server is done with it:
+//with "chain" the last server broadcasts it, with "ring" it goes around to
+//ringCoordinator, which broadcasts it. the hops themselves always run
+//0, 1, ..., n-1, since that's the order clients seal their layers in, so
+//the ring closes on the output and not on the shuffle (see handoff)
+var topology = "chain"
+var ringCoordinator = 0
+
+func checkTopology(numServers int) error {
+	switch topology {
+	case "chain":
+		return nil
+	case "ring":
+		if ringCoordinator < 0 || ringCoordinator >= numServers {
+			return fmt.Errorf("ring coordinator %d out of range (have %d servers)", ringCoordinator, numServers)
+		}
+		return nil
+	}
+	return fmt.Errorf("Unknown topology %s [chain|ring]", topology)
+}
+
+//hands the last hop's output to everyone through method, or with a ring,
+//to the coordinator through collect
+func (s *Server) publish(method string, collect string, args interface{}) error {
+	if topology == "ring" && s.id != ringCoordinator {
+		return s.callPeer(ringCoordinator, collect, args, nil)
+	}
+	return s.broadcast(method, args)
+}
+
+//the last hop's shuffled requests, for the ring coordinator to broadcast
+func (s *Server) CollectRequests(rs *[]Request, _ *int) (err error) {
+	defer recoverRPC("CollectRequests", &err)
+	return s.broadcast("Server.PutPlainRequests", rs)
+}
+
+//the last hop's shuffled blocks, for the ring coordinator to broadcast
+func (s *Server) CollectBlocks(batch *BlockBatch, _ *int) (err error) {
+	defer recoverRPC("CollectBlocks", &err)
+	return s.broadcast("Server.PutPlainBlocks", batch)
+}
@@ -0,0 +1,17 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+//logs one hop of a client call that carries a trace id, so its path can
+//be followed across every server's log; untraced calls aren't logged.
+//traces stop at the shuffles, which exist to unlink clients from their
+//blocks; the shuffle hops show up by round with -logphases
+func traceLog(trace string, round uint64, format string, args ...interface{}) {
+	if trace == "" {
+		return
+	}
+	log.Printf("round %d: trace %s: %s", round, trace, fmt.Sprintf(format, args...))
+}
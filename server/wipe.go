@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+)
+
+//overwrites b in place, rather than leaving it to the garbage collector
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+//zeroes client i's masks and secrets for every round slot
+func (s *Server) wipeClient(i int) {
+	s.chainLock.Lock()
+	defer s.chainLock.Unlock()
+	for r := range s.maskss {
+		zero(s.maskss[r][i])
+		zero(s.secretss[r][i])
+	}
+}
+
+func (s *Server) wipeClients() {
+	for i := 0; i < s.totalClients; i++ {
+		s.wipeClient(i)
+	}
+}
+
+func (s *Server) hasDeparted(i int) bool {
+	s.chainLock.Lock()
+	defer s.chainLock.Unlock()
+	return s.departed[i]
+}
+
+//the client is leaving for good; its masks and secrets here are wiped, and
+//it can't download anymore
+func (s *Server) Deregister(id int, _ *int) (err error) {
+	defer recoverRPC("Deregister", &err)
+	i, err := s.clientIndex(id)
+	if err != nil {
+		return err
+	}
+	//marked first, so its chains aren't advanced or reseeded once zeroed
+	s.chainLock.Lock()
+	s.departed[i] = true
+	s.chainLock.Unlock()
+	s.wipeClient(i)
+	return nil
+}
+
+func errDeparted(i int) error {
+	return fmt.Errorf("Client %d deregistered", i+clientIdBase)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"sync"
+)
+
+//how many goroutines each phase does its cpu bound work on at once, so
+//they can be tuned apart instead of all running NumCPU wide [0 for one
+//per item, as before]
+var shuffleWorkers = 0 //key shuffle rows being shuffled and proven
+var decryptWorkers = 0 //key decryptions per row, and secretbox opens per batch
+
+//goroutines waiting on clients' inputs in a gather [0 for one per client];
+//fewer means slow clients hold up the ones queued behind them
+var gatherWorkers = 0
+
+//at most n holders at once; a nil limiter never blocks
+type limiter chan bool
+
+func newLimiter(n int) limiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(limiter, n)
+}
+
+func (l limiter) acquire() {
+	if l != nil {
+		l <- true
+	}
+}
+
+func (l limiter) release() {
+	if l != nil {
+		<-l
+	}
+}
+
+//calls get for clients 0..n-1 on gatherWorkers goroutines, recording what
+//arrived in got and arrived; once stop closes, the remaining gets return
+//false right away
+func startGets(n int, get func(int, chan bool) bool, stop chan bool, got []bool, arrived chan int) *sync.WaitGroup {
+	workers := gatherWorkers
+	if workers <= 0 || workers > n {
+		workers = n
+	}
+	next := make(chan int, n)
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg := new(sync.WaitGroup)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				got[i] = get(i, stop)
+				if got[i] {
+					arrived <- i
+				}
+			}
+		}()
+	}
+	return wg
+}